@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Aggregate functions computed per field and window
+const (
+	aggregateMean  = "mean"
+	aggregateMin   = "min"
+	aggregateMax   = "max"
+	aggregateLast  = "last"
+	aggregateCount = "count"
+)
+
+// aggregateFunctions lists the functions an aggregation can compute
+var aggregateFunctions = []string{aggregateMean, aggregateMin, aggregateMax, aggregateLast, aggregateCount}
+
+// aggregation writes one point per tumbling window instead of every point. Each field is written as
+// <field>_<function> for each function, at the start of the window.
+type aggregation struct {
+	Window    *duration `json:"window"`     // length of the windows, which are aligned to the Unix epoch
+	Functions []string  `json:"functions"`  // of mean, min, max, last and count (default mean)
+	Bucket    string    `json:"bucket"`     // bucket aggregated points are written to (default the point's bucket)
+	RawBucket string    `json:"raw_bucket"` // if set, the points are also written unaggregated to this bucket
+}
+
+// validate checks the aggregation of a rule
+func (a *aggregation) validate() error {
+	var errs []error
+	if a.Window.value() <= 0 {
+		errs = append(errs, errors.New("window: must be positive"))
+	}
+	for _, function := range a.Functions {
+		if !containsString(aggregateFunctions, function) {
+			errs = append(errs, fmt.Errorf("functions: unknown function %q (must be one of %s)", function, strings.Join(aggregateFunctions, ", ")))
+		}
+	}
+	if a.Bucket == "tag" || a.RawBucket == "tag" {
+		errs = append(errs, errors.New(`"tag" is not a valid bucket`))
+	}
+	return errors.Join(errs...)
+}
+
+// functions returns the functions to compute
+func (a *aggregation) functions() []string {
+	if len(a.Functions) == 0 {
+		return []string{aggregateMean}
+	}
+	return a.Functions
+}
+
+// fieldAggregate accumulates the values of one field in a window. min, max and last keep the type of the value.
+type fieldAggregate struct {
+	count    int64       // values of any type
+	numbers  int64       // numeric values
+	sum      float64     // of the numeric values
+	min, max interface{} // numeric values
+	last     interface{}
+	lastTime time.Time
+}
+
+// add adds a value written at time at
+func (f *fieldAggregate) add(value interface{}, at time.Time) {
+	f.count++
+	if f.count == 1 || !at.Before(f.lastTime) {
+		f.last, f.lastTime = value, at
+	}
+	number, ok := toFloat(value)
+	if !ok {
+		return
+	}
+	f.numbers++
+	f.sum += number
+	if low, _ := toFloat(f.min); f.min == nil || number < low {
+		f.min = value
+	}
+	if high, _ := toFloat(f.max); f.max == nil || number > high {
+		f.max = value
+	}
+}
+
+// result returns the value of an aggregate function, or false if it has none (e.g. the mean of strings)
+func (f *fieldAggregate) result(function string) (interface{}, bool) {
+	switch function {
+	case aggregateMean:
+		return f.sum / float64(f.numbers), f.numbers > 0
+	case aggregateMin:
+		return f.min, f.min != nil
+	case aggregateMax:
+		return f.max, f.max != nil
+	case aggregateLast:
+		return f.last, true
+	case aggregateCount:
+		return f.count, true
+	}
+	return nil, false
+}
+
+// window accumulates the points of one series (bucket, measurement and tags) between start and start + the
+// window length
+type window struct {
+	bucket      string
+	measurement string
+	tags        map[string]string
+	start       time.Time
+	length      time.Duration
+	functions   []string
+	fields      map[string]*fieldAggregate
+	updated     time.Time // wall clock time of the last point added
+}
+
+// timeout returns how long the window is kept open after its last point: aggregationIdleTimeout, or twice its length
+// if that is longer
+func (w *window) timeout() time.Duration {
+	if 2*w.length > aggregationIdleTimeout {
+		return 2 * w.length
+	}
+	return aggregationIdleTimeout
+}
+
+// idle reports whether the window has not received a point for its timeout at wall clock time now
+func (w *window) idle(now time.Time) bool {
+	return now.Sub(w.updated) >= w.timeout()
+}
+
+// closedWindow is the last aggregation window written for a series
+type closedWindow struct {
+	start   int64     // UnixNano of its start
+	expires time.Time // wall clock time after which late points are no longer expected and the entry is forgotten
+}
+
+// point returns the aggregated point of the window
+func (w *window) point() InfluxMessage {
+	fields := make(map[string]interface{}, len(w.fields)*len(w.functions))
+	for name, aggregate := range w.fields {
+		for _, function := range w.functions {
+			if value, ok := aggregate.result(function); ok {
+				fields[name+"_"+function] = value
+			}
+		}
+	}
+	return InfluxMessage{Measurement: w.measurement, Tags: w.tags, Fields: fields, Time: w.start}
+}
+
+// windowStart returns the start of the window of the given length that t falls in. time.Time.Truncate aligns to the
+// zero time, so the offset is computed from the Unix epoch instead.
+func windowStart(t time.Time, length time.Duration) time.Time {
+	offset := t.UnixNano() % int64(length)
+	if offset < 0 {
+		offset += int64(length)
+	}
+	return t.Add(-time.Duration(offset))
+}
+
+// aggregate adds point to its window and writes the windows of the same series it closes: a window is closed by the
+// first point of a later window. A point of a window that has already been written is dropped, as writing the window
+// again would replace the complete aggregate with one of the late points only.
+func (o *handler) aggregate(s *settings, a *aggregation, bucket string, point InfluxMessage, now time.Time) {
+	if a.Bucket != "" {
+		bucket = a.Bucket
+	}
+	length := a.Window.value()
+	start := windowStart(point.Time, length)
+	series := pointSeries(bucket, point)
+
+	o.mu.Lock()
+	if o.windows == nil {
+		o.windows = make(map[string]map[int64]*window)
+		o.closedWindows = make(map[string]closedWindow)
+	}
+	if closed, ok := o.closedWindows[series]; ok && start.UnixNano() <= closed.start {
+		o.mu.Unlock()
+		fmt.Printf("Dropping late point for %s/%s at %s: its %s window has already been written\n",
+			bucket, point.Measurement, point.Time.Format(time.RFC3339Nano), length)
+		return
+	}
+	if o.windows[series] == nil {
+		o.windows[series] = make(map[int64]*window)
+	}
+	w, ok := o.windows[series][start.UnixNano()]
+	if !ok {
+		w = &window{
+			bucket:      bucket,
+			measurement: point.Measurement,
+			tags:        point.Tags,
+			start:       start,
+			length:      length,
+			functions:   a.functions(),
+			fields:      make(map[string]*fieldAggregate),
+		}
+		o.windows[series][start.UnixNano()] = w
+	}
+	for name, value := range point.Fields {
+		if w.fields[name] == nil {
+			w.fields[name] = &fieldAggregate{}
+		}
+		w.fields[name].add(value, point.Time)
+	}
+	w.updated = now
+
+	var closed []*window
+	for other, earlier := range o.windows[series] {
+		if other < start.UnixNano() {
+			closed = append(closed, earlier)
+			delete(o.windows[series], other)
+			o.windowClosed(series, earlier)
+		}
+	}
+	o.mu.Unlock()
+
+	o.writeWindows(s, closed)
+}
+
+// closeWindows writes the windows that are idle at wall clock time now (all windows if now is zero), and forgets the
+// last window written for series that have no open window and have been idle for longer than its length and timeout
+func (o *handler) closeWindows(s *settings, now time.Time) {
+	o.mu.Lock()
+	var closed []*window
+	for series, windows := range o.windows {
+		for start, w := range windows {
+			if now.IsZero() || w.idle(now) {
+				closed = append(closed, w)
+				delete(windows, start)
+				o.windowClosed(series, w)
+			}
+		}
+		if len(windows) == 0 {
+			delete(o.windows, series)
+		}
+	}
+	for series, last := range o.closedWindows {
+		if _, open := o.windows[series]; !open && !now.IsZero() && now.After(last.expires) {
+			delete(o.closedWindows, series)
+		}
+	}
+	o.mu.Unlock()
+
+	o.writeWindows(s, closed)
+}
+
+// windowClosed records that the window w of series has been closed (guarded by mu)
+func (o *handler) windowClosed(series string, w *window) {
+	start := w.start.UnixNano()
+	if closed, ok := o.closedWindows[series]; !ok || start > closed.start {
+		o.closedWindows[series] = closedWindow{start: start, expires: w.updated.Add(w.length + w.timeout())}
+	}
+}
+
+// writeWindows writes the aggregated points of closed windows, oldest first
+func (o *handler) writeWindows(s *settings, closed []*window) {
+	sort.Slice(closed, func(i, j int) bool { return closed[i].start.Before(closed[j].start) })
+	for _, w := range closed {
+		o.writePoint(w.bucket, s.Precision.forBucket(w.bucket), w.point())
+	}
+}
+
+// aggregationIdleTimeout is how long a window is kept open after its last point when no point of a later window
+// arrives (e.g. because the source has stopped publishing)
+const aggregationIdleTimeout = time.Minute
+
+// closeIdleWindows periodically writes idle windows until ctx is done
+func closeIdleWindows(ctx context.Context, h *handler) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.closeWindows(h.currentSettings(), now)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestFieldAggregate(t *testing.T) {
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		values   []interface{}
+		expected map[string]interface{} // by function; functions without a result are absent
+	}{
+		{"floats", []interface{}{20.5, 22.0, 21.0}, map[string]interface{}{
+			"mean": 21.166666666666668, "min": 20.5, "max": 22.0, "last": 21.0, "count": int64(3)}},
+		{"integers keep their type", []interface{}{int64(-1393), int64(-1420), int64(-1402)}, map[string]interface{}{
+			"mean": -1405.0, "min": int64(-1420), "max": int64(-1393), "last": int64(-1402), "count": int64(3)}},
+		{"strings", []interface{}{"Bulk", "Absorption"}, map[string]interface{}{
+			"last": "Absorption", "count": int64(2)}},
+		{"booleans", []interface{}{true, false}, map[string]interface{}{
+			"last": false, "count": int64(2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f fieldAggregate
+			for i, value := range tt.values {
+				f.add(value, start.Add(time.Duration(i)*time.Second))
+			}
+			got := make(map[string]interface{})
+			for _, function := range aggregateFunctions {
+				if value, ok := f.result(function); ok {
+					got[function] = value
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	// The last value is the one with the latest time, not the last one added
+	var f fieldAggregate
+	f.add(2.0, start.Add(time.Second))
+	f.add(1.0, start)
+	if last, _ := f.result(aggregateLast); last != 2.0 {
+		t.Errorf("expected the latest value as last, got %v", last)
+	}
+}
+
+func TestHandle_Aggregation(t *testing.T) {
+	h, writes := newRecordingHandler(t)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.Rules = []rule{{Topic: "victron/#", Aggregation: &aggregation{
+		Window:    newDuration(10 * time.Second),
+		Functions: []string{aggregateMean, aggregateMax, aggregateCount},
+		Bucket:    "victron_10s",
+		RawBucket: "victron_raw",
+	}}}
+	s.Precision.Default = "s"
+	h.swapSettings(s)
+
+	start := time.Unix(1782637540, 0) // the start of a window
+	for _, v := range []struct {
+		value  int
+		offset time.Duration
+	}{
+		{-1390, time.Second},
+		{-1420, 6 * time.Second},
+		{-1400, 12 * time.Second}, // closes the first window
+		{-1000, 3 * time.Second},  // too late for the first window, so only written raw
+		{-1410, 14 * time.Second}, // written on shutdown
+	} {
+		h.handle(&paho.Publish{
+			Topic:   "victron/a7f3c19de82b/grid/40/Ac/L3/Power",
+			Payload: []byte(fmt.Sprintf(`{"value": %d, "timestamp": %d}`, v.value, start.Add(v.offset).UnixMilli())),
+		})
+	}
+	h.mu.Lock()
+	open := len(h.windows)
+	h.mu.Unlock()
+	if open != 1 {
+		t.Errorf("expected 1 open window before shutdown, got %d", open)
+	}
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 7 {
+		t.Errorf("expected 5 raw and 2 aggregated points, got %d points", report.flushed)
+	}
+
+	got := writes()
+	sort.Strings(got["victron_10s s"])
+	expected := []string{
+		"grid,device_instance=40,vrm_portal_id=a7f3c19de82b Ac/L3/Power_count=2i,Ac/L3/Power_max=-1390i,Ac/L3/Power_mean=-1405 1782637540",
+		"grid,device_instance=40,vrm_portal_id=a7f3c19de82b Ac/L3/Power_count=2i,Ac/L3/Power_max=-1400i,Ac/L3/Power_mean=-1405 1782637550",
+	}
+	if !reflect.DeepEqual(got["victron_10s s"], expected) {
+		t.Errorf("expected aggregated points %q, got %q", expected, got["victron_10s s"])
+	}
+	if len(got["victron_raw s"]) != 5 {
+		t.Errorf("expected 5 raw points, got %q", got["victron_raw s"])
+	}
+	if _, ok := got["victron s"]; ok {
+		t.Error("expected no points in the decoder's bucket")
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	tests := []struct {
+		at       time.Time
+		length   time.Duration
+		expected time.Time
+	}{
+		{time.Unix(1782637547, 5), 10 * time.Second, time.Unix(1782637540, 0)},
+		{time.Unix(1782637540, 0), 10 * time.Second, time.Unix(1782637540, 0)},
+		// Windows that do not divide a day are aligned to the Unix epoch, not to the zero time
+		{time.Unix(7*60+30, 0), 7 * time.Minute, time.Unix(7*60, 0)},
+		{time.Unix(-30, 0), time.Minute, time.Unix(-60, 0)},
+	}
+	for _, tt := range tests {
+		if got := windowStart(tt.at, tt.length); !got.Equal(tt.expected) {
+			t.Errorf("windowStart(%d, %s) = %d, want %d", tt.at.Unix(), tt.length, got.Unix(), tt.expected.Unix())
+		}
+	}
+}
+
+func TestCloseWindows_Idle(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{})
+	a := &aggregation{Window: newDuration(2 * time.Minute)}
+	now := time.Now()
+	point := InfluxMessage{Measurement: "m", Fields: map[string]interface{}{"v": 1.0}, Time: now}
+
+	h.aggregate(s, a, "b", point, now)
+	h.closeWindows(s, now.Add(3*time.Minute)) // less than twice the window length
+	if len(h.windows["b\x00m\x00"]) != 1 {
+		t.Fatalf("expected the window to stay open, got %v", h.windows)
+	}
+	h.closeWindows(s, now.Add(4*time.Minute))
+	if len(h.windows) != 0 {
+		t.Errorf("expected the idle window to be closed, got %v", h.windows)
+	}
+
+	// The written window is remembered for late points until the series has been idle for its length and timeout
+	h.closeWindows(s, now.Add(5*time.Minute))
+	if len(h.closedWindows) != 1 {
+		t.Fatalf("expected the written window to be remembered, got %v", h.closedWindows)
+	}
+	h.closeWindows(s, now.Add(7*time.Minute))
+	if len(h.closedWindows) != 0 {
+		t.Errorf("expected the idle series to be forgotten, got %v", h.closedWindows)
+	}
+}
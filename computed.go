@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// computedField adds a field whose value is computed by an expression from the other fields and tags of a point
+type computedField struct {
+	Name       string    `json:"name"`       // name of the field added
+	Expression string    `json:"expression"` // see expression.go
+	MaxAge     *duration `json:"max_age"`    // if set, inputs missing from the point are taken from earlier points of its series no older than this
+
+	expression *exprNode
+}
+
+// validate checks a computed field
+func (c *computedField) validate() error {
+	var errs []error
+	if c.Name == "" {
+		errs = append(errs, errors.New("name: must not be empty"))
+	}
+	if _, err := parseExpression(c.Expression); err != nil {
+		errs = append(errs, fmt.Errorf("expression: %w", err))
+	}
+	if c.MaxAge.value() < 0 {
+		errs = append(errs, errors.New("max_age: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// compile parses the expression; validate has checked that it parses
+func (c *computedField) compile() {
+	c.expression, _ = parseExpression(c.Expression)
+}
+
+// computeFields adds the computed fields of r to point, in order, so that an expression can use the fields computed
+// before it. An expression is only evaluated if the point has one of the fields it refers to (or it refers to none).
+// If an input is missing or the value cannot be computed the field is left out; the point keeps its other fields.
+func (o *handler) computeFields(r *rule, bucket string, point InfluxMessage) InfluxMessage {
+	if r == nil || len(r.Computed) == 0 {
+		return point
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fields := make(map[string]interface{}, len(point.Fields)+len(r.Computed))
+	for name, value := range point.Fields {
+		fields[name] = value
+	}
+	for _, c := range r.Computed {
+		if c.MaxAge.value() > 0 {
+			o.rememberFields(bucket, point)
+			break
+		}
+	}
+
+	for _, c := range r.Computed {
+		inputs := c.expression.inputs()
+		triggered := len(inputs) == 0
+		for _, name := range inputs {
+			if _, ok := fields[name]; ok {
+				triggered = true
+			}
+		}
+		if !triggered {
+			continue
+		}
+
+		in := exprInputs{tags: point.Tags, field: func(name string) (interface{}, bool) {
+			if value, ok := fields[name]; ok {
+				return value, true
+			}
+			if c.MaxAge == nil {
+				return nil, false
+			}
+			last, ok := o.recentFields[seriesKey(bucket, point, name)]
+			if !ok || point.Time.Sub(last.written) > c.MaxAge.value() {
+				return nil, false
+			}
+			return last.value, true
+		}}
+		value, err := c.expression.evaluate(in)
+		if number, ok := value.(float64); err == nil && ok && (math.IsNaN(number) || math.IsInf(number, 0)) {
+			err = fmt.Errorf("%v is not a valid value", number)
+		}
+		o.computedFailed(r, c.Name, err)
+		if err == nil {
+			fields[c.Name] = value
+		}
+	}
+	point.Fields = fields
+	return point
+}
+
+// computedFailed logs the error computing field name of rule r (if any) when the field was last computed without
+// one, so that a field whose input is often missing does not log every point (guarded by mu)
+func (o *handler) computedFailed(r *rule, name string, err error) {
+	key := r.Topic + "\x00" + name
+	if err == nil {
+		delete(o.computedFailing, key)
+		return
+	}
+	if o.computedFailing[key] {
+		return
+	}
+	if o.computedFailing == nil {
+		o.computedFailing = make(map[string]bool)
+	}
+	o.computedFailing[key] = true
+	fmt.Printf("Computed field %q of rule %s left out: %s (not logged again until it has been computed)\n", name, r.Topic, err)
+}
+
+// rememberFields records the fields of point as the last values of their series, for computed fields with a max age
+// (guarded by mu)
+func (o *handler) rememberFields(bucket string, point InfluxMessage) {
+	if o.recentFields == nil {
+		o.recentFields = make(map[string]seriesValue)
+	}
+	for name, value := range point.Fields {
+		key := seriesKey(bucket, point, name)
+		if last, ok := o.recentFields[key]; !ok || !point.Time.Before(last.written) {
+			o.recentFields[key] = seriesValue{value: value, written: point.Time}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeFields(t *testing.T) {
+	r := &rule{Computed: []computedField{
+		{Name: "power_net", Expression: "power_delivered - power_returned"},
+		{Name: "power_net_w", Expression: "power_net * 1000"},
+		{Name: "battery_power", Expression: `field("Dc/0/Voltage") * field("Dc/0/Current")`, MaxAge: newDuration(time.Minute)},
+	}}
+	for i := range r.Computed {
+		r.Computed[i].compile()
+	}
+	at := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	battery := map[string]string{"vrm_portal_id": "a7f3c19de82b", "device_instance": "512"}
+	tests := []struct {
+		name     string
+		point    InfluxMessage
+		expected map[string]interface{}
+	}{
+		{"computed from computed", InfluxMessage{Measurement: "p1", Time: at,
+			Fields: map[string]interface{}{"power_delivered": 1.5, "power_returned": 0.25}},
+			map[string]interface{}{"power_delivered": 1.5, "power_returned": 0.25, "power_net": 1.25, "power_net_w": 1250.0}},
+		{"missing input", InfluxMessage{Measurement: "p1", Time: at,
+			Fields: map[string]interface{}{"power_delivered": 1.5}},
+			map[string]interface{}{"power_delivered": 1.5}},
+		{"no inputs", InfluxMessage{Measurement: "p1", Time: at,
+			Fields: map[string]interface{}{"voltage_l1": 230.1}},
+			map[string]interface{}{"voltage_l1": 230.1}},
+		{"input not seen yet", InfluxMessage{Measurement: "battery", Tags: battery, Time: at,
+			Fields: map[string]interface{}{"Dc/0/Voltage": 52.0}},
+			map[string]interface{}{"Dc/0/Voltage": 52.0}},
+		{"input from an earlier point", InfluxMessage{Measurement: "battery", Tags: battery, Time: at.Add(time.Second),
+			Fields: map[string]interface{}{"Dc/0/Current": -10.5}},
+			map[string]interface{}{"Dc/0/Current": -10.5, "battery_power": -546.0}},
+		{"input too old", InfluxMessage{Measurement: "battery", Tags: battery, Time: at.Add(2 * time.Minute),
+			Fields: map[string]interface{}{"Dc/0/Current": -10.0}},
+			map[string]interface{}{"Dc/0/Current": -10.0}},
+	}
+	h := &handler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := h.computeFields(r, "victron", tt.point)
+			if !reflect.DeepEqual(got.Fields, tt.expected) {
+				t.Errorf("expected fields %v, got %v", tt.expected, got.Fields)
+			}
+		})
+	}
+}
+
+func TestHandle_ComputedFields(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	path := writeRulesFile(t, `{"rules": [{"topic": "victron/#", "computed": [
+		{"name": "Dc/0/Power", "expression": "field(\"Dc/0/Voltage\") * field(\"Dc/0/Current\")", "max_age": "10s"}]}]}`)
+	s, err := loadSettings(config{topic: "victron/#", rulesFile: path})
+	if err != nil {
+		t.Fatalf("loadSettings returned error: %v", err)
+	}
+	h.swapSettings(s)
+
+	// Parsed expressions must not make a reload of the same file look like a change
+	reloaded, err := loadSettings(config{topic: "victron/#", rulesFile: path})
+	if err != nil {
+		t.Fatalf("loadSettings returned error: %v", err)
+	}
+	if changes := diffSettings(s, reloaded); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+
+	// The first voltage is written without the power, as there is no current yet
+	h.handle(testPublish("victron/a7f3c19de82b/battery/512/Dc/0/Voltage", `{"value": 52.1, "timestamp": 1782637540000}`, false, false))
+	h.handle(testPublish("victron/a7f3c19de82b/battery/512/Dc/0/Current", `{"value": -10.2, "timestamp": 1782637541000}`, false, false))
+	h.handle(testPublish("victron/a7f3c19de82b/battery/512/Dc/0/Voltage", `{"value": 52.2, "timestamp": 1782637542000}`, false, false))
+	h.handle(testPublish("victron/a7f3c19de82b/battery/512/Soc", `{"value": 80, "timestamp": 1782637543000}`, false, false))
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 4 {
+		t.Errorf("expected 4 points flushed, got %s", report)
+	}
+}
+
+func TestComputedField_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     computedField
+		valid bool
+	}{
+		{"valid", computedField{Name: "power", Expression: "voltage * current"}, true},
+		{"no name", computedField{Expression: "voltage * current"}, false},
+		{"invalid expression", computedField{Name: "power", Expression: "voltage *"}, false},
+		{"negative max age", computedField{Name: "power", Expression: "voltage", MaxAge: newDuration(-time.Second)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid=%v", err, tt.valid)
+			}
+			if err != nil && tt.name == "invalid expression" && !strings.Contains(err.Error(), "expression:") {
+				t.Errorf("expected the error to name the expression, got %v", err)
+			}
+		})
+	}
+}
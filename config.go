@@ -34,6 +34,10 @@ const (
 
 	envInfluxWriteBatchSize = "INFLUXDB_WRITE_BATCH_SIZE"  // max points per write batch
 	envInfluxFlushInterval  = "INFLUXDB_FLUSH_INTERVAL_MS" // periodic flush interval in milliseconds
+
+	envShutdownTimeout = "SHUTDOWN_TIMEOUT_MS" // deadline for draining and flushing on shutdown in milliseconds
+
+	envRulesFile = "RULESFILE" // JSON file holding settings that are re-read on SIGHUP (optional)
 )
 
 // config holds the configuration
@@ -59,6 +63,10 @@ type config struct {
 	influxWriteBatchSize uint          // max points in a single async write batch
 	influxFlushInterval  time.Duration // async write flush interval
 
+	shutdownTimeout time.Duration // deadline for draining in-flight messages and flushing writes on shutdown
+
+	rulesFile string // path to the reloadable settings file (if blank the defaults are used)
+
 	debug bool // autopaho and paho debug output requested
 }
 
@@ -110,6 +118,7 @@ func getConfig() (config, error) {
 	}
 
 	cfg.sessionFolder = os.Getenv(envSessionFolder)
+	cfg.rulesFile = os.Getenv(envRulesFile)
 
 	if cfg.debug, err = booleanFromEnvWithDefault(envDebug, false); err != nil {
 		return config{}, err
@@ -142,6 +151,11 @@ func getConfig() (config, error) {
 		return config{}, err
 	}
 
+	cfg.shutdownTimeout, err = milliSecondsFromEnvWithDefault(envShutdownTimeout, 5000)
+	if err != nil {
+		return config{}, err
+	}
+
 	return cfg, nil
 }
 
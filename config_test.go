@@ -230,6 +230,9 @@ func TestInfluxWriteBatchSizeDefault(t *testing.T) {
 	if cfg.influxFlushInterval != 1000*time.Millisecond {
 		t.Errorf("expected default influxFlushInterval 1000ms, got %v", cfg.influxFlushInterval)
 	}
+	if cfg.shutdownTimeout != 5000*time.Millisecond {
+		t.Errorf("expected default shutdownTimeout 5000ms, got %v", cfg.shutdownTimeout)
+	}
 }
 
 func TestInfluxWriteBatchSizeZeroRejected(t *testing.T) {
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deadband only lets a field be written when its value has changed by more than a threshold since the value last
+// written to the same series, or when the series has been silent for too long. Without thresholds any change is
+// written (report by exception).
+type deadband struct {
+	Absolute   float64   `json:"absolute"`    // write numbers that changed by more than this
+	Relative   float64   `json:"relative"`    // write numbers that changed by more than this fraction of the last value
+	MaxSilence *duration `json:"max_silence"` // write unchanged values once this long has passed since the last write
+}
+
+// validate checks the deadband of a rule
+func (d *deadband) validate() error {
+	var errs []error
+	if d.Absolute < 0 {
+		errs = append(errs, errors.New("absolute: must not be negative"))
+	}
+	if d.Relative < 0 {
+		errs = append(errs, errors.New("relative: must not be negative"))
+	}
+	if d.MaxSilence.value() < 0 {
+		errs = append(errs, errors.New("max_silence: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// seriesValue is the value last written to a series and the time of its point
+type seriesValue struct {
+	value   interface{}
+	written time.Time
+}
+
+// passes reports whether value, at time at, should be written given the value last written to its series
+func (d *deadband) passes(last seriesValue, value interface{}, at time.Time) bool {
+	if silence := d.MaxSilence.value(); silence > 0 && at.Sub(last.written) >= silence {
+		return true
+	}
+	current, isNumber := toFloat(value)
+	previous, wasNumber := toFloat(last.value)
+	if !isNumber || !wasNumber {
+		return value != last.value
+	}
+	change := math.Abs(current - previous)
+	if d.Absolute == 0 && d.Relative == 0 {
+		return change > 0
+	}
+	return (d.Absolute > 0 && change > d.Absolute) || (d.Relative > 0 && change > d.Relative*math.Abs(previous))
+}
+
+// pointSeries identifies the series of a point: bucket, measurement and tags
+func pointSeries(bucket string, point InfluxMessage) string {
+	tags := make([]string, 0, len(point.Tags))
+	for k, v := range point.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return bucket + "\x00" + point.Measurement + "\x00" + strings.Join(tags, ",")
+}
+
+// seriesKey identifies the series of a field: the series of its point and the field name
+func seriesKey(bucket string, point InfluxMessage, field string) string {
+	return pointSeries(bucket, point) + "\x00" + field
+}
+
+// applyDeadband removes the fields of point that are within the deadband and records the others as written
+func (o *handler) applyDeadband(d *deadband, bucket string, point InfluxMessage) InfluxMessage {
+	if d == nil {
+		return point
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.seriesValues == nil {
+		o.seriesValues = make(map[string]seriesValue)
+	}
+
+	fields := make(map[string]interface{}, len(point.Fields))
+	for name, value := range point.Fields {
+		key := seriesKey(bucket, point, name)
+		if last, ok := o.seriesValues[key]; ok && !d.passes(last, value, point.Time) {
+			continue
+		}
+		fields[name] = value
+		o.seriesValues[key] = seriesValue{value: value, written: point.Time}
+	}
+	point.Fields = fields
+	return point
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestDeadband_Passes(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	last := func(value interface{}) seriesValue {
+		return seriesValue{value: value, written: now.Add(-time.Minute)}
+	}
+	tests := []struct {
+		name     string
+		deadband deadband
+		last     seriesValue
+		value    interface{}
+		expected bool
+	}{
+		{"unchanged", deadband{}, last(12.5), 12.5, false},
+		{"any change", deadband{}, last(12.5), 12.6, true},
+		{"integer unchanged", deadband{}, last(int64(230)), int64(230), false},
+		{"integer to float", deadband{}, last(int64(230)), 230.0, false},
+		{"within absolute", deadband{Absolute: 1}, last(100.0), 100.9, false},
+		{"beyond absolute", deadband{Absolute: 1}, last(100.0), 98.5, true},
+		{"within relative", deadband{Relative: 0.05}, last(int64(-2000)), int64(-2090), false},
+		{"beyond relative", deadband{Relative: 0.05}, last(int64(-2000)), int64(-2110), true},
+		{"relative from zero", deadband{Relative: 0.05}, last(0.0), 0.001, true},
+		{"beyond either", deadband{Absolute: 50, Relative: 0.01}, last(1000.0), 1020.0, true},
+		{"within both", deadband{Absolute: 50, Relative: 0.05}, last(1000.0), 1020.0, false},
+		{"boolean unchanged", deadband{Absolute: 1}, last(true), true, false},
+		{"boolean changed", deadband{Absolute: 1}, last(true), false, true},
+		{"string changed", deadband{}, last("Bulk"), "Float", true},
+		{"type changed", deadband{}, last("Off"), 0.0, true},
+		{"heartbeat", deadband{Absolute: 1, MaxSilence: newDuration(time.Minute)}, last(100.0), 100.0, true},
+		{"before heartbeat", deadband{Absolute: 1, MaxSilence: newDuration(2 * time.Minute)}, last(100.0), 100.0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.deadband.passes(tt.last, tt.value, now); got != tt.expected {
+				t.Errorf("passes(%v → %v) = %v, want %v", tt.last.value, tt.value, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandle_Deadband(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.Rules = []rule{{Topic: "victron/#", Deadband: &deadband{Absolute: 10, MaxSilence: newDuration(time.Minute)}}}
+	h.swapSettings(s)
+
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	values := []struct {
+		value int
+		after time.Duration
+	}{
+		{-1393, 0},                // first value of the series
+		{-1398, 5 * time.Second},  // within the deadband
+		{-1420, 5 * time.Second},  // beyond it
+		{-1415, 5 * time.Second},  // within the deadband
+		{-1415, 70 * time.Second}, // heartbeat
+	}
+	at := start
+	for _, v := range values {
+		at = at.Add(v.after)
+		h.handle(&paho.Publish{
+			Topic:   "victron/a7f3c19de82b/grid/40/Ac/L3/Power",
+			Payload: []byte(fmt.Sprintf(`{"value": %d, "timestamp": %d}`, v.value, at.UnixMilli())),
+		})
+	}
+	// Other series are tracked separately
+	h.handle(&paho.Publish{
+		Topic:   "victron/a7f3c19de82b/grid/40/Ac/L2/Power",
+		Payload: []byte(fmt.Sprintf(`{"value": -1398, "timestamp": %d}`, start.UnixMilli())),
+	})
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 4 {
+		t.Errorf("expected 4 points, got %d", report.flushed)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Payload formats, as named in the content_types setting
+const (
+	formatJSON         = "json"
+	formatText         = "text"
+	formatLineProtocol = "line_protocol"
+	formatProtobuf     = "protobuf"
+)
+
+// payloadFormats lists the formats content types can be mapped to
+var payloadFormats = []string{formatJSON, formatText, formatLineProtocol, formatProtobuf, formatCBOR, formatMsgPack}
+
+// decoder turns the messages on the topics it claims into points
+type decoder struct {
+	name    string
+	formats []string // payload formats the decoder understands
+	matches func(s *settings, topic string) bool
+	handle  func(o *handler, s *settings, msg *paho.Publish, at timestamps)
+}
+
+// decoders lists the built-in decoders in the order they are tried; the first one that claims a topic handles it.
+// Topics configured for a decoder come first, then decoders with a fixed topic prefix and finally those that look for
+// a word anywhere in the topic.
+var decoders = []decoder{
+	{
+		name:    "scalar",
+		formats: []string{formatText},
+		matches: func(s *settings, topic string) bool {
+			return s.scalarFor(topic) != nil
+		},
+		handle: (*handler).handleScalarMessage,
+	},
+	{
+		name:    "line protocol",
+		formats: []string{formatLineProtocol},
+		matches: func(s *settings, topic string) bool {
+			return s.lineProtocolFor(topic) != nil
+		},
+		handle: (*handler).handleLineProtocolMessage,
+	},
+	{
+		name:    "solaredge",
+		formats: []string{formatJSON},
+		matches: hasPrefix("solaredge/"),
+		handle: func(o *handler, s *settings, msg *paho.Publish, at timestamps) {
+			o.handleSolarMessage(s, msg, at)
+		},
+	},
+	{
+		name:    "venus",
+		formats: []string{formatJSON},
+		matches: hasPrefix("N/"),
+		handle:  (*handler).handleVictronMessage,
+	},
+	{
+		name:    "sparkplug",
+		formats: []string{formatProtobuf},
+		matches: hasPrefix("spBv1.0/"),
+		handle:  (*handler).handleSparkplugMessage,
+	},
+	{
+		name:    "zigbee2mqtt",
+		formats: []string{formatJSON},
+		matches: func(s *settings, topic string) bool {
+			return strings.HasPrefix(topic, s.Zigbee2MQTT.BaseTopic+"/")
+		},
+		handle: (*handler).handleZigbeeMessage,
+	},
+	{
+		name:    "tasmota",
+		formats: []string{formatJSON},
+		matches: func(_ *settings, topic string) bool {
+			return strings.HasPrefix(topic, "tele/") && strings.HasSuffix(topic, "/SENSOR")
+		},
+		handle: (*handler).handleTasmotaMessage,
+	},
+	{
+		name:    "shelly",
+		formats: []string{formatJSON},
+		matches: func(_ *settings, topic string) bool {
+			return strings.HasSuffix(topic, "/events/rpc")
+		},
+		handle: (*handler).handleShellyMessage,
+	},
+	{
+		name:    "p1",
+		formats: []string{formatJSON, formatText},
+		matches: contains("p1"),
+		handle:  (*handler).handleP1Message,
+	},
+	{
+		name:    "sensors",
+		formats: []string{formatJSON},
+		matches: contains("sensors"),
+		handle:  (*handler).handleSensorMessage,
+	},
+	{
+		name:    "victron",
+		formats: []string{formatJSON},
+		matches: hasPrefix("victron/"),
+		handle:  (*handler).handleVictronMessage,
+	},
+}
+
+// findDecoder returns the first decoder that claims topic (or nil if there is none). If format is set, decoders
+// that do not understand it are passed over.
+func findDecoder(s *settings, topic string, format string) *decoder {
+	for i := range decoders {
+		if format != "" && !containsString(decoders[i].formats, format) {
+			continue
+		}
+		if decoders[i].matches(s, topic) {
+			return &decoders[i]
+		}
+	}
+	return nil
+}
+
+// payloadFormat returns the format named by the message's MQTT v5 content type or, failing that, the encoding set by
+// the rule for its topic. It returns "" if neither says what the payload is.
+func (s *settings) payloadFormat(msg *paho.Publish) string {
+	if msg.Properties != nil && msg.Properties.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(msg.Properties.ContentType)
+		if format := s.ContentTypes[mediaType]; err == nil && format != "" {
+			return format
+		}
+	}
+	if r := s.ruleFor(msg.Topic); r != nil {
+		return r.Encoding
+	}
+	return ""
+}
+
+// decodePayload transcodes CBOR and MessagePack payloads to JSON. It returns the message to decode and its format,
+// which is unchanged for other formats.
+func decodePayload(msg *paho.Publish, format string) (*paho.Publish, string, error) {
+	if format != formatCBOR && format != formatMsgPack {
+		return msg, format, nil
+	}
+	payload, err := transcodeToJSON(format, msg.Payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s payload could not be decoded: %w", format, err)
+	}
+	decoded := *msg
+	decoded.Payload = payload
+	return &decoded, formatJSON, nil
+}
+
+func hasPrefix(prefix string) func(*settings, string) bool {
+	return func(_ *settings, topic string) bool {
+		return strings.HasPrefix(topic, prefix)
+	}
+}
+
+func contains(word string) func(*settings, string) bool {
+	return func(_ *settings, topic string) bool {
+		return strings.Contains(topic, word)
+	}
+}
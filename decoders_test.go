@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestFindDecoder(t *testing.T) {
+	s := defaultSettings(config{})
+	tests := map[string]string{
+		"solaredge/inverter":                    "solaredge",
+		"N/c0619ab1f2e3/system/0/Serial":        "venus",
+		"spBv1.0/plant1/NDATA/line3":            "sparkplug",
+		"zigbee2mqtt/p1_sensors_plug":           "zigbee2mqtt",
+		"tele/plug-kitchen/SENSOR":              "tasmota",
+		"shellies/p1pm-garage/events/rpc":       "shelly",
+		"p1/home":                               "p1",
+		"sensors/temperature/livingroom/t1":     "sensors",
+		"victron/a7f3c19de82b/grid/40/Ac/Power": "victron",
+	}
+	for topic, name := range tests {
+		if d := findDecoder(s, topic, ""); d == nil || d.name != name {
+			t.Errorf("expected topic %q to be handled by %s, got %+v", topic, name, d)
+		}
+	}
+	if d := findDecoder(s, "homeassistant/status", ""); d != nil {
+		t.Errorf("expected no decoder for an unknown topic, got %s", d.name)
+	}
+}
+
+func TestFindDecoder_HonoursContentType(t *testing.T) {
+	s := defaultSettings(config{})
+	s.Scalars = []scalarTopic{{Topic: "sensors/+/+", Bucket: "home", Measurement: "{2}", Tags: map[string]string{"location": "{3}"}}}
+
+	if d := findDecoder(s, "sensors/temperature/livingroom", ""); d == nil || d.name != "scalar" {
+		t.Errorf("expected configured scalar topic to be handled by scalar without a content type, got %+v", d)
+	}
+	if d := findDecoder(s, "sensors/temperature/livingroom", formatJSON); d == nil || d.name != "sensors" {
+		t.Errorf("expected JSON payload to be handled by sensors, got %+v", d)
+	}
+	if d := findDecoder(s, "p1/home", formatText); d == nil || d.name != "p1" {
+		t.Errorf("expected text payload on a P1 topic to be handled by p1, got %+v", d)
+	}
+	if d := findDecoder(s, "victron/a7f3c19de82b/grid/40/Ac/Power", formatProtobuf); d != nil {
+		t.Errorf("expected no decoder for protobuf on a victron topic, got %s", d.name)
+	}
+}
+
+func TestPayloadFormat(t *testing.T) {
+	s := defaultSettings(config{})
+	tests := map[string]string{
+		"":                                 "",
+		"application/json":                 formatJSON,
+		"Text/Plain; charset=utf-8":        formatText,
+		"application/x-protobuf":           formatProtobuf,
+		"application/vnd.something+json":   "",
+		"not a media type; charset=utf-8;": "",
+	}
+	for contentType, expected := range tests {
+		msg := &paho.Publish{Topic: "a/b", Properties: &paho.PublishProperties{ContentType: contentType}}
+		if got := s.payloadFormat(msg); got != expected {
+			t.Errorf("payloadFormat(%q) = %q, want %q", contentType, got, expected)
+		}
+	}
+	if got := s.payloadFormat(&paho.Publish{Topic: "a/b"}); got != "" {
+		t.Errorf("expected no format without properties, got %q", got)
+	}
+}
+
+func TestHandle_UserPropertyTags(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+
+	path := writeRulesFile(t, `{
+		"user_property_tags": ["site", "device"],
+		"content_types": {"Application/CBOR-Test": "json"},
+		"rules": [{"topic": "sensors/#", "tags": {"device": "from-rule"}}]
+	}`)
+	s, err := loadSettings(config{topic: "#", rulesFile: path})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if s.ContentTypes["application/json"] != formatJSON || s.ContentTypes["application/cbor-test"] != formatJSON {
+		t.Errorf("expected content types to be added to the defaults, got %v", s.ContentTypes)
+	}
+
+	msg := &paho.Publish{
+		Topic:   "sensors/temperature/livingroom/t1",
+		Payload: []byte(`{"unit": "C", "value": 21.5}`),
+		Properties: &paho.PublishProperties{
+			ContentType: "application/json",
+			User:        paho.UserProperties{{Key: "site", Value: "home"}, {Key: "device", Value: "esp32"}, {Key: "other", Value: "x"}},
+		},
+	}
+	point := s.addUserPropertyTags(msg, InfluxMessage{Tags: map[string]string{"location": "livingroom"}})
+	if point.Tags["site"] != "home" || point.Tags["device"] != "esp32" || point.Tags["location"] != "livingroom" {
+		t.Errorf("expected selected user properties as tags, got %v", point.Tags)
+	}
+	if _, ok := point.Tags["other"]; ok {
+		t.Error("expected unselected user properties not to be copied")
+	}
+
+	h.swapSettings(s)
+	h.handle(msg)
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if _, ok := h.writeAPIs["sensors"]; !ok || report.flushed != 1 {
+		t.Errorf("expected the point to be written to the sensors bucket, got %d points in %v", report.flushed, h.writeAPIs)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Policies for retained messages, which the broker sends again on every (re)subscribe
+const (
+	retainedProcess = "process" // handle retained messages like any other
+	retainedSkip    = "skip"    // ignore retained messages
+	retainedChanged = "changed" // handle a retained message only if it differs from the last message seen on its topic
+)
+
+// retainedPolicies lists the values of dedup.retained
+var retainedPolicies = []string{retainedProcess, retainedSkip, retainedChanged}
+
+// dedupFileName is the file in the session folder the deduplicator's state is saved to on shutdown
+const dedupFileName = "dedup.json"
+
+// lruEntry is a key remembered by an lruCache
+type lruEntry struct {
+	Key  string    `json:"key"`
+	Hash uint64    `json:"hash"` // payload hash
+	Seen time.Time `json:"seen"` // when the key was last seen
+}
+
+// lruCache remembers up to size keys; the key seen least recently is forgotten first
+type lruCache struct {
+	size  int
+	order *list.List // of *lruEntry, most recently seen first
+	index map[string]*list.Element
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// get returns the entry for key. Entries last seen before since are treated as forgotten.
+func (c *lruCache) get(key string, since time.Time) (lruEntry, bool) {
+	element, ok := c.index[key]
+	if !ok {
+		return lruEntry{}, false
+	}
+	entry := element.Value.(*lruEntry)
+	if entry.Seen.Before(since) {
+		c.order.Remove(element)
+		delete(c.index, key)
+		return lruEntry{}, false
+	}
+	return *entry, true
+}
+
+// put records that key was seen with a payload hash, forgetting the least recently seen keys beyond size
+func (c *lruCache) put(key string, hash uint64, seen time.Time) {
+	if element, ok := c.index[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.Hash, entry.Seen = hash, seen
+		c.order.MoveToFront(element)
+	} else {
+		c.index[key] = c.order.PushFront(&lruEntry{Key: key, Hash: hash, Seen: seen})
+	}
+	c.resize(c.size)
+}
+
+// resize changes the number of keys remembered, forgetting the least recently seen ones if there are more
+func (c *lruCache) resize(size int) {
+	c.size = size
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.index, oldest.Value.(*lruEntry).Key)
+	}
+}
+
+// entries returns the remembered entries, least recently seen first
+func (c *lruCache) entries() []lruEntry {
+	entries := make([]lruEntry, 0, c.order.Len())
+	for element := c.order.Back(); element != nil; element = element.Prev() {
+		entries = append(entries, *element.Value.(*lruEntry))
+	}
+	return entries
+}
+
+// dedupState is what the deduplicator saves to disk
+type dedupState struct {
+	Messages []lruEntry `json:"messages"`
+	Retained []lruEntry `json:"retained"`
+}
+
+// deduplicator recognises messages the broker delivers again: QoS 1/2 messages redelivered after a reconnect and
+// retained messages re-sent on resubscribe. The zero value is ready to use.
+type deduplicator struct {
+	mu       sync.Mutex
+	messages *lruCache // topic and payload hash of recent messages
+	latest   *lruCache // payload hash of the last message on each topic
+	file     string    // file the state is saved to and loaded from ("" if it is held in memory only)
+}
+
+// payloadHash returns the hash messages are compared by
+func payloadHash(payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(payload)
+	return h.Sum64()
+}
+
+// persisted reports whether the remembered messages are saved and loaded: only if persist is set and they are used,
+// by duplicate suppression or the "changed" retained policy
+func (cfg dedupSettings) persisted() bool {
+	return *cfg.Persist && (*cfg.Enabled || cfg.Retained == retainedChanged)
+}
+
+// skip records msg and reports whether it should be skipped as a duplicate or by the retained policy
+func (d *deduplicator) skip(cfg dedupSettings, msg *paho.Publish, now time.Time) bool {
+	if !*cfg.Enabled && cfg.Retained == retainedProcess {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.messages == nil {
+		d.messages, d.latest = newLRUCache(cfg.Size), newLRUCache(cfg.Size)
+	}
+	d.messages.resize(cfg.Size)
+	d.latest.resize(cfg.Size)
+
+	hash := payloadHash(msg.Payload)
+	key := msg.Topic + "\x00" + strconv.FormatUint(hash, 16)
+	_, seen := d.messages.get(key, now.Add(-cfg.TTL.value()))
+	last, hasLast := d.latest.get(msg.Topic, time.Time{})
+	d.messages.put(key, hash, now)
+	d.latest.put(msg.Topic, hash, now)
+
+	if msg.Retain {
+		switch cfg.Retained {
+		case retainedSkip:
+			return true
+		case retainedChanged:
+			return hasLast && last.Hash == hash
+		}
+		return false
+	}
+	return *cfg.Enabled && seen && (msg.Duplicate() || !*cfg.FlaggedOnly)
+}
+
+// load reads the state saved by save (if any)
+func (d *deduplicator) load() error {
+	if d.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(d.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state dedupState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %w", d.file, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages, d.latest = newLRUCache(len(state.Messages)), newLRUCache(len(state.Retained))
+	for _, entry := range state.Messages {
+		d.messages.put(entry.Key, entry.Hash, entry.Seen)
+	}
+	for _, entry := range state.Retained {
+		d.latest.put(entry.Key, entry.Hash, entry.Seen)
+	}
+	return nil
+}
+
+// save writes the state to the file (if there is one), replacing it atomically
+func (d *deduplicator) save() error {
+	d.mu.Lock()
+	if d.file == "" || d.messages == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	state := dedupState{Messages: d.messages.entries(), Retained: d.latest.entries()}
+	d.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.file, data)
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash leaves either the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// testPublish returns a message as received from the broker, with the DUP and retain flags set as given
+func testPublish(topic, payload string, duplicate, retain bool) *paho.Publish {
+	return paho.PublishFromPacketPublish(&packets.Publish{
+		QoS:        1,
+		Duplicate:  duplicate,
+		Retain:     retain,
+		Topic:      topic,
+		Payload:    []byte(payload),
+		Properties: &packets.Properties{},
+	})
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	c := newLRUCache(2)
+	c.put("a", 1, now)
+	c.put("b", 2, now.Add(time.Second))
+	c.put("a", 3, now.Add(2*time.Second)) // a is now the most recent
+	c.put("c", 4, now.Add(3*time.Second)) // b is forgotten
+
+	if _, ok := c.get("b", time.Time{}); ok {
+		t.Error("expected the least recently seen key to be forgotten")
+	}
+	if entry, ok := c.get("a", time.Time{}); !ok || entry.Hash != 3 {
+		t.Errorf("expected a with hash 3, got %+v %v", entry, ok)
+	}
+	if _, ok := c.get("a", now.Add(5*time.Second)); ok {
+		t.Error("expected a key seen before since to be treated as forgotten")
+	}
+	if entries := c.entries(); len(entries) != 1 || entries[0].Key != "c" {
+		t.Errorf("expected only c to be left, got %+v", entries)
+	}
+	c.resize(0)
+	if entries := c.entries(); len(entries) != 0 {
+		t.Errorf("expected no entries after resize, got %+v", entries)
+	}
+}
+
+func TestDeduplicator_Skip(t *testing.T) {
+	type delivery struct {
+		msg   *paho.Publish
+		after time.Duration // since the previous delivery
+		skip  bool
+	}
+	enabled := func(d dedupSettings) dedupSettings {
+		d.Enabled = newBool(true)
+		return d
+	}
+	defaults := defaultSettings(config{}).Dedup
+	all := enabled(defaults)
+	all.FlaggedOnly = newBool(false)
+	skipRetained, changedRetained := defaults, defaults
+	skipRetained.Retained = retainedSkip
+	changedRetained.Retained = retainedChanged
+
+	tests := []struct {
+		name       string
+		cfg        dedupSettings
+		deliveries []delivery
+	}{
+		{"disabled", defaults, []delivery{
+			{testPublish("p1/home", "a", false, false), 0, false},
+			{testPublish("p1/home", "a", true, false), 0, false},
+		}},
+		{"redelivery", enabled(defaults), []delivery{
+			{testPublish("p1/home", "a", false, false), 0, false},
+			{testPublish("p1/home", "a", true, false), time.Second, true},
+			{testPublish("p1/other", "a", true, false), 0, false},
+			{testPublish("p1/home", "b", true, false), 0, false},
+		}},
+		{"repeated value without DUP flag", enabled(defaults), []delivery{
+			{testPublish("sensors/t/l/1", "21.5", false, false), 0, false},
+			{testPublish("sensors/t/l/1", "21.5", false, false), time.Minute, false},
+		}},
+		{"all repeats", all, []delivery{
+			{testPublish("sensors/t/l/1", "21.5", false, false), 0, false},
+			{testPublish("sensors/t/l/1", "21.5", false, false), time.Minute, true},
+		}},
+		{"expired", enabled(defaults), []delivery{
+			{testPublish("p1/home", "a", false, false), 0, false},
+			{testPublish("p1/home", "a", true, false), 11 * time.Minute, false},
+		}},
+		{"skip retained", skipRetained, []delivery{
+			{testPublish("zigbee2mqtt/plug", "on", false, true), 0, true},
+			{testPublish("zigbee2mqtt/plug", "off", false, false), 0, false},
+		}},
+		{"changed retained", changedRetained, []delivery{
+			{testPublish("zigbee2mqtt/plug", "on", false, true), 0, false},
+			{testPublish("zigbee2mqtt/plug", "on", false, true), time.Hour, true},
+			{testPublish("zigbee2mqtt/plug", "off", false, false), 0, false},
+			{testPublish("zigbee2mqtt/plug", "off", false, true), time.Hour, true},
+			{testPublish("zigbee2mqtt/plug", "on", false, true), 0, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d deduplicator
+			now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+			for i, delivery := range tt.deliveries {
+				now = now.Add(delivery.after)
+				if got := d.skip(tt.cfg, delivery.msg, now); got != delivery.skip {
+					t.Errorf("delivery %d (%s %q): skip = %v, want %v", i, delivery.msg.Topic, delivery.msg.Payload, got, delivery.skip)
+				}
+			}
+		})
+	}
+}
+
+func TestDeduplicator_SaveAndLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), dedupFileName)
+	cfg := defaultSettings(config{}).Dedup
+	cfg.Enabled = newBool(true)
+	cfg.Retained = retainedChanged
+	now := time.Now()
+
+	saved := deduplicator{file: file}
+	saved.skip(cfg, testPublish("p1/home", "a", false, false), now)
+	saved.skip(cfg, testPublish("zigbee2mqtt/plug", "on", false, true), now)
+	if err := saved.save(); err != nil {
+		t.Fatalf("save returned error: %v", err)
+	}
+
+	loaded := deduplicator{file: file}
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load returned error: %v", err)
+	}
+	if !loaded.skip(cfg, testPublish("p1/home", "a", true, false), now) {
+		t.Error("expected a redelivery of a saved message to be skipped")
+	}
+	if !loaded.skip(cfg, testPublish("zigbee2mqtt/plug", "on", false, true), now) {
+		t.Error("expected a replay of a saved retained message to be skipped")
+	}
+
+	missing := deduplicator{file: filepath.Join(t.TempDir(), dedupFileName)}
+	if err := missing.load(); err != nil {
+		t.Errorf("expected no error without a saved state, got %v", err)
+	}
+}
+
+func TestNewHandler_LoadsDedupStateIfPersisted(t *testing.T) {
+	folder := t.TempDir()
+	cfg := defaultSettings(config{}).Dedup
+	cfg.Enabled = newBool(true)
+	saved := deduplicator{file: filepath.Join(folder, dedupFileName)}
+	saved.skip(cfg, testPublish("p1/home", "a", false, false), time.Now())
+	if err := saved.save(); err != nil {
+		t.Fatalf("save returned error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		retained string
+		persist  bool
+		loaded   bool
+	}{
+		{"enabled", true, retainedProcess, true, true},
+		{"not persisted", true, retainedProcess, false, false},
+		{"disabled", false, retainedProcess, true, false},
+		{"changed retained", false, retainedChanged, true, true},
+	}
+	for _, tt := range tests {
+		s := defaultSettings(config{topic: "#"})
+		s.Dedup.Enabled = newBool(tt.enabled)
+		s.Dedup.Retained = tt.retained
+		s.Dedup.Persist = newBool(tt.persist)
+		h := NewHandler(config{sessionFolder: folder}, s)
+		if loaded := h.dedup.messages != nil; loaded != tt.loaded {
+			t.Errorf("%s: state loaded = %v, want %v", tt.name, loaded, tt.loaded)
+		}
+		h.client.Close()
+	}
+}
+
+func TestShutdown_SavesDedupStateOnlyIfUsed(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	h.dedup.file = filepath.Join(t.TempDir(), dedupFileName)
+	h.handle(testPublish("p1/home", "a", false, false))
+
+	if _, err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if _, err := os.Stat(h.dedup.file); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no state file with duplicate suppression disabled, got %v", err)
+	}
+}
+
+func TestHandle_SkipsRedeliveries(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.Dedup.Enabled = newBool(true)
+	h.swapSettings(s)
+
+	payload := `{"value": -1393, "timestamp": 1782637540236}`
+	h.handle(testPublish("victron/a7f3c19de82b/grid/40/Ac/L3/Power", payload, false, false))
+	h.handle(testPublish("victron/a7f3c19de82b/grid/40/Ac/L3/Power", payload, true, false))
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 1 || report.skipped != 1 {
+		t.Errorf("expected 1 point flushed and 1 message skipped, got %s", report)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Binary encodings of JSON-shaped payloads. Messages in these formats are transcoded to JSON and handed to the JSON
+// decoders, so they produce the same points as their JSON equivalents.
+const (
+	formatCBOR    = "cbor"
+	formatMsgPack = "msgpack"
+)
+
+// binaryEncodings lists the encodings a rule can select
+var binaryEncodings = []string{formatCBOR, formatMsgPack}
+
+// transcodeToJSON decodes a CBOR or MessagePack payload and encodes it as JSON
+func transcodeToJSON(encoding string, payload []byte) ([]byte, error) {
+	var value interface{}
+	var err error
+	switch encoding {
+	case formatCBOR:
+		err = cbor.Unmarshal(payload, &value)
+	case formatMsgPack:
+		err = msgpack.Unmarshal(payload, &value)
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJSON writes a decoded CBOR or MessagePack value as JSON. Unlike json.Marshal it always writes floats with a
+// fraction or exponent, so that a float that happens to be whole is not taken for an integer. Map keys that are not
+// strings are written in their decimal or text form; byte strings are written as base64 strings.
+func writeJSON(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case float32:
+		writeJSONFloat(buf, float64(v), 32)
+	case float64:
+		writeJSONFloat(buf, v, 64)
+	case string, []byte, time.Time:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(encoded)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, element := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, element); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		return writeJSONObject(buf, keys, func(key string) interface{} { return v[key] })
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(v))
+		values := make(map[string]interface{}, len(v))
+		for key, member := range v {
+			name := fmt.Sprint(key)
+			keys = append(keys, name)
+			values[name] = member
+		}
+		return writeJSONObject(buf, keys, func(key string) interface{} { return values[key] })
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			buf.WriteString(strconv.FormatInt(rv.Int(), 10))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			buf.WriteString(strconv.FormatUint(rv.Uint(), 10))
+		default:
+			return fmt.Errorf("cannot convert %T to JSON", v)
+		}
+	}
+	return nil
+}
+
+// writeJSONObject writes an object with the given keys in sorted order
+func writeJSONObject(buf *bytes.Buffer, keys []string, member func(string) interface{}) error {
+	sort.Strings(keys)
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encoded, _ := json.Marshal(key)
+		buf.Write(encoded)
+		buf.WriteByte(':')
+		if err := writeJSON(buf, member(key)); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeJSONFloat writes f with a fraction or exponent; NaN and infinities, which JSON cannot represent, become null
+func writeJSONFloat(buf *bytes.Buffer, f float64, bitSize int) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		buf.WriteString("null")
+		return
+	}
+	text := strconv.FormatFloat(f, 'g', -1, bitSize)
+	buf.WriteString(text)
+	if !strings.ContainsAny(text, ".eE") {
+		buf.WriteString(".0")
+	}
+}
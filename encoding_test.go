@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestTranscodeToJSON(t *testing.T) {
+	value := map[string]interface{}{
+		"value":     21.0,
+		"count":     uint8(3),
+		"offset":    int16(-2),
+		"ratio":     float32(0.25),
+		"ok":        true,
+		"unit":      "C",
+		"readings":  []interface{}{1.5, int64(2)},
+		"missing":   nil,
+		"timestamp": 1782637540236,
+	}
+	expected := `{"count":3,"missing":null,"offset":-2,"ok":true,"ratio":0.25,"readings":[1.5,2],"timestamp":1782637540236,"unit":"C","value":21.0}`
+
+	for _, encoding := range []string{formatCBOR, formatMsgPack} {
+		t.Run(encoding, func(t *testing.T) {
+			var payload []byte
+			var err error
+			if encoding == formatCBOR {
+				payload, err = cbor.Marshal(value)
+			} else {
+				payload, err = msgpack.Marshal(value)
+			}
+			if err != nil {
+				t.Fatalf("failed to encode test payload: %v", err)
+			}
+			got, err := transcodeToJSON(encoding, payload)
+			if err != nil {
+				t.Fatalf("transcodeToJSON returned error: %v", err)
+			}
+			if string(got) != expected {
+				t.Errorf("transcodeToJSON() = %s, want %s", got, expected)
+			}
+		})
+	}
+
+	if _, err := transcodeToJSON(formatCBOR, []byte{0xff, 0x00}); err == nil {
+		t.Error("expected error for invalid CBOR")
+	}
+}
+
+func TestTranscodeToJSON_IdenticalPoints(t *testing.T) {
+	values := defaultSettings(config{}).Values
+	topic := "victron/a7f3c19de82b/grid/40/Ac"
+	jsonPayload := []byte(`{"value": {"Power": -1393, "Energy": 12.5, "Relay": true}, "timestamp": 1782637540236}`)
+
+	cborPayload, err := cbor.Marshal(map[string]interface{}{
+		"value":     map[string]interface{}{"Power": -1393, "Energy": 12.5, "Relay": true},
+		"timestamp": 1782637540236,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcoded, err := transcodeToJSON(formatCBOR, cborPayload)
+	if err != nil {
+		t.Fatalf("transcodeToJSON returned error: %v", err)
+	}
+
+	_, fromJSON, err := buildVictronPoint(values, topic, jsonPayload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fromCBOR, err := buildVictronPoint(values, topic, transcoded, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromCBOR) {
+		t.Errorf("expected identical points, got %+v from JSON and %+v from CBOR", fromJSON, fromCBOR)
+	}
+}
+
+func TestTranscodeToJSON_CBORTimestamp(t *testing.T) {
+	at := time.Date(2026, 5, 1, 12, 0, 0, 500000000, time.UTC)
+	payload, err := cbor.Marshal(map[string]interface{}{"unit": "C", "value": 21.5, "timestamp": cbor.Tag{Number: 0, Content: at.Format(time.RFC3339Nano)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcoded, err := transcodeToJSON(formatCBOR, payload)
+	if err != nil {
+		t.Fatalf("transcodeToJSON returned error: %v", err)
+	}
+	var message sensorMessage
+	if err := json.Unmarshal(transcoded, &message); err != nil {
+		t.Fatalf("transcoded payload could not be decoded: %v (%s)", err, transcoded)
+	}
+	timestamp, err := receivedAt(time.Now()).parse(message.Timestamp, timestampFormat{})
+	if err != nil {
+		t.Fatalf("transcoded timestamp could not be parsed: %v (%s)", err, transcoded)
+	}
+	if !timestamp.Equal(at) {
+		t.Errorf("expected timestamp %v, got %v", at, timestamp)
+	}
+}
+
+func TestHandle_BinaryEncodings(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.Rules = []rule{{Topic: "+/humidity/#", Encoding: formatMsgPack}}
+	h.swapSettings(s)
+
+	cborPayload, _ := cbor.Marshal(map[string]interface{}{"unit": "C", "value": 21.5})
+	msgpackPayload, _ := msgpack.Marshal(map[string]interface{}{"unit": "%", "value": 48})
+
+	h.handle(&paho.Publish{
+		Topic:      "sensors/temperature/livingroom/t1",
+		Payload:    cborPayload,
+		Properties: &paho.PublishProperties{ContentType: "application/cbor"},
+	})
+	h.handle(&paho.Publish{Topic: "sensors/humidity/livingroom/h1", Payload: msgpackPayload})
+	h.handle(&paho.Publish{
+		Topic:      "sensors/temperature/livingroom/t1",
+		Payload:    []byte("not cbor"),
+		Properties: &paho.PublishProperties{ContentType: "application/cbor"},
+	})
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 2 {
+		t.Errorf("expected the CBOR and MessagePack points, got %d points", report.flushed)
+	}
+}
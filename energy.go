@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// energyFileName is the file in the session folder the integrated energy totals are saved to
+const energyFileName = "energy.json"
+
+// defaultMaxGap is the max_gap of integrations that do not set it
+const defaultMaxGap = 5 * time.Minute
+
+// integration turns a power field into a cumulative energy field in kWh, integrating the power over the point times
+// with the trapezoidal rule
+type integration struct {
+	Field  string    `json:"field"`   // power field to integrate
+	Unit   string    `json:"unit"`    // unit of the power field (default W)
+	Name   string    `json:"name"`    // energy field added (default <field>_kwh)
+	MaxGap *duration `json:"max_gap"` // intervals between readings longer than this are not integrated (default 5m)
+}
+
+// validate checks an integration of a rule
+func (in *integration) validate() error {
+	var errs []error
+	if in.Field == "" {
+		errs = append(errs, errors.New("field: must not be empty"))
+	}
+	if u, ok := units[in.unit()]; !ok || u.dimension != "power" {
+		errs = append(errs, fmt.Errorf("unit: %q is not a unit of power", in.unit()))
+	}
+	if in.name() == in.Field {
+		errs = append(errs, errors.New("name: must differ from field"))
+	}
+	if in.MaxGap != nil && in.MaxGap.value() <= 0 {
+		errs = append(errs, errors.New("max_gap: must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// unit returns the unit of the power field
+func (in *integration) unit() string {
+	if in.Unit == "" {
+		return "W"
+	}
+	return in.Unit
+}
+
+// name returns the name of the energy field
+func (in *integration) name() string {
+	if in.Name == "" {
+		return in.Field + "_kwh"
+	}
+	return in.Name
+}
+
+// maxGap returns the longest interval between readings that is integrated
+func (in *integration) maxGap() time.Duration {
+	if in.MaxGap == nil {
+		return defaultMaxGap
+	}
+	return in.MaxGap.value()
+}
+
+// energyTotal is the integrated energy of a series and the reading it was last integrated up to
+type energyTotal struct {
+	KWh   float64   `json:"kwh"`
+	Watts float64   `json:"watts"` // last power reading
+	Time  time.Time `json:"time"`  // time of the last power reading
+}
+
+// integrator keeps the energy totals of the integrations by series. The zero value is ready to use.
+type integrator struct {
+	mu     sync.Mutex
+	totals map[string]*energyTotal
+	file   string // file the totals are saved to and loaded from ("" if they are held in memory only)
+}
+
+// add integrates a power reading of watts at time at into the total of series key and returns the total in kWh.
+// Readings that are not later than the last one leave the total unchanged; after a gap longer than maxGap
+// integration restarts from the reading.
+func (g *integrator) add(key string, watts float64, at time.Time, maxGap time.Duration) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.totals == nil {
+		g.totals = make(map[string]*energyTotal)
+	}
+	total, ok := g.totals[key]
+	if !ok {
+		total = &energyTotal{Watts: watts, Time: at}
+		g.totals[key] = total
+		return total.KWh
+	}
+	elapsed := at.Sub(total.Time)
+	if elapsed <= 0 {
+		return total.KWh
+	}
+	if elapsed <= maxGap {
+		total.KWh += (total.Watts + watts) / 2 * elapsed.Hours() / 1000
+	}
+	total.Watts, total.Time = watts, at
+	return total.KWh
+}
+
+// load reads the totals saved by save (if any)
+func (g *integrator) load() error {
+	if g.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(g.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var totals map[string]*energyTotal
+	if err := json.Unmarshal(data, &totals); err != nil {
+		return fmt.Errorf("%s: %w", g.file, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.totals = totals
+	return nil
+}
+
+// save writes the totals to the file (if there is one), replacing it atomically
+func (g *integrator) save() error {
+	// Held while writing, as the totals are saved periodically and on shutdown
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.file == "" || g.totals == nil {
+		return nil
+	}
+	data, err := json.Marshal(g.totals)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(g.file, data)
+}
+
+// warnEnergyNotSaved logs a warning if rules of s integrate energy but there is no session folder, so the totals
+// restart from zero with the bridge
+func warnEnergyNotSaved(cfg config, s *settings) {
+	if cfg.sessionFolder != "" {
+		return
+	}
+	for _, r := range s.Rules {
+		if len(r.Integrate) > 0 {
+			fmt.Printf("Rule %s integrates energy but %s is not set, so the totals do not survive a restart\n", r.Topic, envSessionFolder)
+			return
+		}
+	}
+}
+
+// integrate adds the energy fields of the integrations of r to point, for the power fields it has
+func (o *handler) integrate(r *rule, bucket string, point InfluxMessage) InfluxMessage {
+	if r == nil || len(r.Integrate) == 0 {
+		return point
+	}
+	var fields map[string]interface{}
+	for i := range r.Integrate {
+		in := &r.Integrate[i]
+		watts, ok := convertValue(point.Fields[in.Field], in.unit(), "W")
+		if !ok {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]interface{}, len(point.Fields)+len(r.Integrate))
+			for name, value := range point.Fields {
+				fields[name] = value
+			}
+		}
+		fields[in.name()] = o.energy.add(seriesKey(bucket, point, in.Field), watts, point.Time, in.maxGap())
+	}
+	if fields != nil {
+		point.Fields = fields
+	}
+	return point
+}
+
+// stateSaveInterval is how often the energy totals and field types are saved while running, so that little is lost if
+// the bridge does not shut down cleanly
+const stateSaveInterval = time.Minute
+
+// saveState periodically saves the energy totals and field types until ctx is done
+func saveState(ctx context.Context, h *handler) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.energy.save(); err != nil {
+				fmt.Printf("Failed to save energy totals: %s\n", err)
+			}
+			if err := h.saveFieldKinds(); err != nil {
+				fmt.Printf("Failed to save field types: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIntegrator_Add(t *testing.T) {
+	var g integrator
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		watts    float64
+		offset   time.Duration
+		expected float64
+	}{
+		{"first reading", 1000, 0, 0},
+		{"constant power", 1000, time.Hour, 1},
+		{"trapezoid", 3000, 90 * time.Minute, 2},
+		{"repeated reading", 3000, 90 * time.Minute, 2},
+		{"earlier reading", 500, time.Hour, 2},
+		{"after a gap", 500, 3 * time.Hour, 2},
+		{"restarted from the gap", 1500, 210 * time.Minute, 2.5},
+	}
+	for _, tt := range tests {
+		got := g.add("key", tt.watts, start.Add(tt.offset), time.Hour)
+		if math.Abs(got-tt.expected) > 1e-9 {
+			t.Errorf("%s: expected %v kWh, got %v", tt.name, tt.expected, got)
+		}
+	}
+	if got := g.add("other", 1000, start.Add(4*time.Hour), time.Hour); got != 0 {
+		t.Errorf("expected series to be integrated separately, got %v kWh", got)
+	}
+}
+
+func TestIntegrator_SaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), energyFileName)
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	g := integrator{file: file}
+	g.add("key", 2000, start, time.Hour)
+	g.add("key", 2000, start.Add(30*time.Minute), time.Hour)
+	if err := g.save(); err != nil {
+		t.Fatalf("save returned error: %v", err)
+	}
+
+	loaded := integrator{file: file}
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load returned error: %v", err)
+	}
+	if got := loaded.add("key", 2000, start.Add(time.Hour), time.Hour); math.Abs(got-2) > 1e-9 {
+		t.Errorf("expected the total to continue from the saved one, got %v kWh", got)
+	}
+
+	missing := integrator{file: filepath.Join(t.TempDir(), energyFileName)}
+	if err := missing.load(); err != nil {
+		t.Errorf("expected no error without saved totals, got %v", err)
+	}
+}
+
+func TestHandle_Integration(t *testing.T) {
+	h, writes := newRecordingHandler(t)
+	defer h.Close()
+	h.energy.file = filepath.Join(t.TempDir(), energyFileName)
+	s := defaultSettings(config{topic: "#"})
+	s.Rules = []rule{{Topic: "victron/#", Integrate: []integration{{Field: "Ac/Power", Name: "Ac/Energy"}}}}
+	s.Precision.Default = "s"
+	h.swapSettings(s)
+
+	h.handle(testPublish("victron/a7f3c19de82b/vebus/276/Ac/Power", `{"value": 1200, "timestamp": 1782637540000}`, false, false))
+	h.handle(testPublish("victron/a7f3c19de82b/vebus/276/Ac/Power", `{"value": 1800, "timestamp": 1782637600000}`, false, false))
+	h.handle(testPublish("victron/a7f3c19de82b/vebus/276/Ac/Voltage", `{"value": 230, "timestamp": 1782637600000}`, false, false))
+
+	if _, err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	expected := []string{
+		"vebus,device_instance=276,vrm_portal_id=a7f3c19de82b Ac/Energy=0,Ac/Power=1200i 1782637540",
+		"vebus,device_instance=276,vrm_portal_id=a7f3c19de82b Ac/Energy=0.025,Ac/Power=1800i 1782637600",
+		"vebus,device_instance=276,vrm_portal_id=a7f3c19de82b Ac/Voltage=230i 1782637600",
+	}
+	if got := writes()["victron s"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected writes %q, got %q", expected, got)
+	}
+
+	saved := integrator{file: h.energy.file}
+	if err := saved.load(); err != nil {
+		t.Fatalf("expected the totals to be saved on shutdown, got %v", err)
+	}
+	if len(saved.totals) != 1 {
+		t.Errorf("expected 1 saved total, got %v", saved.totals)
+	}
+}
+
+func TestIntegration_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    integration
+		valid bool
+	}{
+		{"valid", integration{Field: "ac_power_w"}, true},
+		{"kilowatts", integration{Field: "power_delivered", Unit: "kW", Name: "energy_delivered"}, true},
+		{"no field", integration{Name: "energy"}, false},
+		{"not a power unit", integration{Field: "energy", Unit: "kWh"}, false},
+		{"name of the power field", integration{Field: "power", Name: "power"}, false},
+		{"negative max gap", integration{Field: "power", MaxGap: newDuration(-time.Minute)}, false},
+		{"zero max gap", integration{Field: "power", MaxGap: newDuration(0)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.in.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid=%v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// An expression computes a value from the fields and tags of a point. The language has numbers, strings, true and
+// false; field references (a bare name such as power_delivered, or field("Dc/0/Voltage") for names with other
+// characters); tag("name"); the operators + - * / % == != < <= > >= && || ! and parentheses; and the functions
+// abs, sqrt, round, min, max, has and if. Numbers are float64; integer fields and numeric tags are converted.
+
+// exprNode is a node of a parsed expression. It holds no functions, so parsed settings can be compared with
+// reflect.DeepEqual.
+type exprNode struct {
+	kind  string      // exprLiteral, exprField, exprTag, exprCall or an operator
+	value interface{} // exprLiteral: the value
+	name  string      // exprField and exprTag: the field or tag name; exprCall: the function
+	args  []*exprNode // operands of operators and arguments of functions
+}
+
+// Kinds of expression nodes that are not operators
+const (
+	exprLiteral = "literal"
+	exprField   = "field"
+	exprTag     = "tag"
+	exprCall    = "call"
+)
+
+// exprFunctions maps the functions of the language to their least and greatest number of arguments (-1 for no limit)
+var exprFunctions = map[string][2]int{
+	"abs": {1, 1}, "sqrt": {1, 1}, "round": {1, 2}, "min": {1, -1}, "max": {1, -1}, "has": {1, 1}, "if": {3, 3},
+}
+
+// exprPrecedence maps the binary operators to their precedence (higher binds tighter)
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+// exprToken is a token of an expression: a number, string, name or operator
+type exprToken struct {
+	kind string // "number", "string", "name" or "op"
+	text string
+	pos  int
+}
+
+// tokenize splits an expression into tokens
+func tokenize(expression string) ([]exprToken, error) {
+	var tokens []exprToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				(runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, exprToken{"number", string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{"name", string(runes[start:i]), start})
+		case r == '"':
+			start := i
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{"string", string(runes[start:i]), start})
+		default:
+			start := i
+			if i+1 < len(runes) {
+				if op := string(runes[i : i+2]); exprPrecedence[op] > 0 {
+					tokens = append(tokens, exprToken{"op", op, start})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!(),", r) {
+				return nil, fmt.Errorf("unexpected %q at %d", r, start)
+			}
+			tokens = append(tokens, exprToken{"op", string(r), start})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser parses the tokens of an expression by precedence climbing
+type exprParser struct {
+	tokens []exprToken
+	next   int
+}
+
+// parseExpression parses an expression
+func parseExpression(expression string) (*exprNode, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.binary(1)
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.tokens[p.next].text, p.tokens[p.next].pos)
+	}
+	return node, nil
+}
+
+// peek returns the next token, or a zero token at the end
+func (p *exprParser) peek() exprToken {
+	if p.next < len(p.tokens) {
+		return p.tokens[p.next]
+	}
+	return exprToken{}
+}
+
+// expect consumes the next token, which must be the operator op
+func (p *exprParser) expect(op string) error {
+	if t := p.peek(); t.kind != "op" || t.text != op {
+		if t.kind == "" {
+			return fmt.Errorf("expected %q at the end", op)
+		}
+		return fmt.Errorf("expected %q at %d, got %q", op, t.pos, t.text)
+	}
+	p.next++
+	return nil
+}
+
+// binary parses a sequence of operands joined by binary operators of at least precedence minimum
+func (p *exprParser) binary(minimum int) (*exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		precedence := exprPrecedence[t.text]
+		if t.kind != "op" || precedence < minimum {
+			return left, nil
+		}
+		p.next++
+		right, err := p.binary(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{kind: t.text, args: []*exprNode{left, right}}
+	}
+}
+
+// unary parses an operand, which may be negated
+func (p *exprParser) unary() (*exprNode, error) {
+	if t := p.peek(); t.kind == "op" && (t.text == "-" || t.text == "!") {
+		p.next++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{kind: t.text, args: []*exprNode{operand}}, nil
+	}
+	return p.primary()
+}
+
+// primary parses a literal, field reference, function call or parenthesised expression
+func (p *exprParser) primary() (*exprNode, error) {
+	t := p.peek()
+	p.next++
+	switch t.kind {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "number":
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return &exprNode{kind: exprLiteral, value: value}, nil
+	case "string":
+		value, err := strconv.Unquote(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s at %d", t.text, t.pos)
+		}
+		return &exprNode{kind: exprLiteral, value: value}, nil
+	case "name":
+		if next := p.peek(); next.kind == "op" && next.text == "(" {
+			return p.call(t)
+		}
+		switch t.text {
+		case "true", "false":
+			return &exprNode{kind: exprLiteral, value: t.text == "true"}, nil
+		}
+		return &exprNode{kind: exprField, name: t.text}, nil
+	}
+	if t.text != "(" {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	node, err := p.binary(1)
+	if err != nil {
+		return nil, err
+	}
+	return node, p.expect(")")
+}
+
+// call parses the arguments of a call of the function named by t
+func (p *exprParser) call(t exprToken) (*exprNode, error) {
+	p.next++ // (
+	var args []*exprNode
+	for p.peek().text != ")" || p.peek().kind != "op" {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.binary(1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next++ // )
+
+	switch t.text {
+	case exprField, exprTag:
+		// The name must be known when the expression is parsed, so that its inputs are known
+		if len(args) != 1 || args[0].kind != exprLiteral {
+			return nil, fmt.Errorf("%s at %d: takes one string", t.text, t.pos)
+		}
+		name, ok := args[0].value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s at %d: takes one string", t.text, t.pos)
+		}
+		return &exprNode{kind: t.text, name: name}, nil
+	case "has":
+		if len(args) == 1 && args[0].kind == exprLiteral {
+			if name, ok := args[0].value.(string); ok {
+				args[0] = &exprNode{kind: exprField, name: name}
+			}
+		}
+		if len(args) != 1 || args[0].kind != exprField {
+			return nil, fmt.Errorf("has at %d: takes one field", t.pos)
+		}
+	}
+	arity, ok := exprFunctions[t.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", t.text, t.pos)
+	}
+	if len(args) < arity[0] || arity[1] >= 0 && len(args) > arity[1] {
+		return nil, fmt.Errorf("%s at %d: wrong number of arguments", t.text, t.pos)
+	}
+	return &exprNode{kind: exprCall, name: t.text, args: args}, nil
+}
+
+// inputs returns the names of the fields the expression refers to
+func (n *exprNode) inputs() []string {
+	var names []string
+	if n.kind == exprField {
+		names = append(names, n.name)
+	}
+	for _, arg := range n.args {
+		for _, name := range arg.inputs() {
+			if !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// exprInputs gives an expression access to the fields and tags of a point
+type exprInputs struct {
+	field func(name string) (interface{}, bool)
+	tags  map[string]string
+}
+
+// errMissingInput is returned by evaluate when a field or tag the expression needs is missing
+var errMissingInput = errors.New("missing input")
+
+// evaluate computes the value of the expression
+func (n *exprNode) evaluate(in exprInputs) (interface{}, error) {
+	switch n.kind {
+	case exprLiteral:
+		return n.value, nil
+	case exprField:
+		value, ok := in.field(n.name)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %q", errMissingInput, n.name)
+		}
+		return value, nil
+	case exprTag:
+		value, ok := in.tags[n.name]
+		if !ok {
+			return nil, fmt.Errorf("%w: tag %q", errMissingInput, n.name)
+		}
+		return value, nil
+	case exprCall:
+		return n.call(in)
+	case "&&", "||":
+		left, err := n.args[0].boolean(in)
+		if err != nil || left == (n.kind == "||") {
+			return left, err
+		}
+		return n.args[1].boolean(in)
+	case "!":
+		operand, err := n.args[0].boolean(in)
+		return !operand, err
+	case "-":
+		if len(n.args) == 1 {
+			operand, err := n.args[0].number(in)
+			return -operand, err
+		}
+	}
+
+	left, err := n.args[0].evaluate(in)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.args[1].evaluate(in)
+	if err != nil {
+		return nil, err
+	}
+	switch n.kind {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	}
+	a, err := exprNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	b, err := exprNumber(right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.kind {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "%":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if n.kind == "%" {
+			return math.Mod(a, b), nil
+		}
+		return a / b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.kind)
+}
+
+// call evaluates a function call
+func (n *exprNode) call(in exprInputs) (interface{}, error) {
+	switch n.name {
+	case "has":
+		_, ok := in.field(n.args[0].name)
+		return ok, nil
+	case "if":
+		condition, err := n.args[0].boolean(in)
+		if err != nil {
+			return nil, err
+		}
+		if condition {
+			return n.args[1].evaluate(in)
+		}
+		return n.args[2].evaluate(in)
+	}
+
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.number(in)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	switch n.name {
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "sqrt":
+		return math.Sqrt(args[0]), nil
+	case "round":
+		scale := 1.0
+		if len(args) == 2 {
+			scale = math.Pow(10, args[1])
+		}
+		return math.Round(args[0]*scale) / scale, nil
+	case "min":
+		result := args[0]
+		for _, value := range args[1:] {
+			result = math.Min(result, value)
+		}
+		return result, nil
+	case "max":
+		result := args[0]
+		for _, value := range args[1:] {
+			result = math.Max(result, value)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unknown function %q", n.name)
+}
+
+// number evaluates the expression as a number
+func (n *exprNode) number(in exprInputs) (float64, error) {
+	value, err := n.evaluate(in)
+	if err != nil {
+		return 0, err
+	}
+	return exprNumber(value)
+}
+
+// boolean evaluates the expression as a boolean
+func (n *exprNode) boolean(in exprInputs) (bool, error) {
+	value, err := n.evaluate(in)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%v is not a boolean", value)
+	}
+	return b, nil
+}
+
+// exprNumber converts a value to a number; strings (such as tags) must hold one
+func exprNumber(value interface{}) (float64, error) {
+	if number, ok := toFloat(value); ok {
+		return number, nil
+	}
+	if s, ok := value.(string); ok {
+		if number, err := strconv.ParseFloat(s, 64); err == nil {
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a number", fmt.Sprint(value))
+}
+
+// exprEqual compares two values, as numbers if both are numeric
+func exprEqual(a, b interface{}) bool {
+	x, aIsNumber := toFloat(a)
+	y, bIsNumber := toFloat(b)
+	if aIsNumber && bIsNumber {
+		return x == y
+	}
+	return a == b
+}
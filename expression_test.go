@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestExpression_Evaluate(t *testing.T) {
+	in := exprInputs{
+		field: func(name string) (interface{}, bool) {
+			value, ok := map[string]interface{}{
+				"voltage":          230.0,
+				"current":          int64(5),
+				"power_delivered":  1.193,
+				"power_returned":   0.25,
+				"Dc/0/Voltage":     52.0,
+				"Dc/0/Current":     -10.5,
+				"state":            "Bulk",
+				"power_failures":   uint64(4),
+				"relay_on":         true,
+				"measurement.temp": 21.5,
+			}[name]
+			return value, ok
+		},
+		tags: map[string]string{"phase": "L1", "device_instance": "40"},
+	}
+	tests := []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"voltage * current", 1150.0},
+		{"power_delivered - power_returned", 0.943},
+		{`field("Dc/0/Voltage") * field("Dc/0/Current")`, -546.0},
+		{"1 + 2 * 3 - 4 / 2", 5.0},
+		{"(1 + 2) * 3", 9.0},
+		{"-voltage + 10", -220.0},
+		{"7 % 4", 3.0},
+		{"2.5e3", 2500.0},
+		{"abs(field(\"Dc/0/Current\"))", 10.5},
+		{"sqrt(16)", 4.0},
+		{"round(power_delivered, 1)", 1.2},
+		{"round(2.5)", 3.0},
+		{"min(voltage, 100, current)", 5.0},
+		{"max(1, 2)", 2.0},
+		{`state == "Bulk"`, true},
+		{`tag("phase") == "L1" && relay_on`, true},
+		{`tag("device_instance") + 1`, 41.0},
+		{"current == 5", true},
+		{"power_failures >= 5 || !relay_on", false},
+		{"if(has(missing), missing, -1)", -1.0},
+		{`if(has("Dc/0/Voltage"), 1, missing)`, 1.0},
+		{"false && missing", false},
+		{"measurement.temp", 21.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			node, err := parseExpression(tt.expression)
+			if err != nil {
+				t.Fatalf("parseExpression returned error: %v", err)
+			}
+			got, err := node.evaluate(in)
+			if err != nil {
+				t.Fatalf("evaluate returned error: %v", err)
+			}
+			if number, ok := got.(float64); ok {
+				got = math.Round(number*1e6) / 1e6
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestExpression_EvaluateErrors(t *testing.T) {
+	in := exprInputs{
+		field: func(name string) (interface{}, bool) {
+			value, ok := map[string]interface{}{"voltage": 230.0, "state": "Bulk"}[name]
+			return value, ok
+		},
+	}
+	tests := []struct {
+		expression string
+		missing    bool
+	}{
+		{"voltage * current", true},
+		{`tag("phase") == "L1"`, true},
+		{"voltage / 0", false},
+		{"state * 2", false},
+		{"if(voltage, 1, 2)", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			node, err := parseExpression(tt.expression)
+			if err != nil {
+				t.Fatalf("parseExpression returned error: %v", err)
+			}
+			_, err = node.evaluate(in)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, errMissingInput) != tt.missing {
+				t.Errorf("expected missing input %v, got %v", tt.missing, err)
+			}
+		})
+	}
+}
+
+func TestParseExpression_Invalid(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"voltage *",
+		"(voltage * current",
+		"voltage current",
+		"voltage = 1",
+		"voltage & current",
+		`"unterminated`,
+		"median(1, 2)",
+		"abs(1, 2)",
+		"if(true, 1)",
+		"min()",
+		"max()",
+		"round()",
+		"round(1, 2, 3)",
+		"field(voltage)",
+		`tag("a", "b")`,
+		"has(1)",
+		"voltage $ 2",
+	} {
+		if _, err := parseExpression(expression); err == nil {
+			t.Errorf("expected an error parsing %q", expression)
+		}
+	}
+}
+
+func TestExpression_Inputs(t *testing.T) {
+	node, err := parseExpression(`voltage * field("Dc/0/Current") + if(has(extra), extra, voltage) + tag("phase")`)
+	if err != nil {
+		t.Fatalf("parseExpression returned error: %v", err)
+	}
+	expected := []string{"voltage", "Dc/0/Current", "extra"}
+	if got := node.inputs(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected inputs %v, got %v", expected, got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 )
@@ -21,13 +22,15 @@ func creatTLSConfigInflux() *tls.Config {
 	return tlsConfig
 }
 
-func influxClient(cfg config) influxdb2.Client {
+// influxClient creates a client that writes points with the given precision
+func influxClient(cfg config, precision time.Duration) influxdb2.Client {
 	var clientOptions = influxdb2.DefaultOptions()
 
 	clientOptions.SetApplicationName("p1DataWriterGo")
 	clientOptions.SetTLSConfig(creatTLSConfigInflux())
 	clientOptions.SetBatchSize(cfg.influxWriteBatchSize)
 	clientOptions.SetFlushInterval(uint(cfg.influxFlushInterval.Milliseconds()))
+	clientOptions.SetPrecision(precision)
 
 	client := influxdb2.NewClientWithOptions(cfg.influxURL, cfg.influxToken, clientOptions)
 	return client
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// lineProtocolTopic marks topics whose payload is already InfluxDB line protocol. Bucket and tag values are templates
+// in which {n} is replaced by the n-th level of the topic (counting from 1).
+type lineProtocolTopic struct {
+	Topic  string            `json:"topic"`  // MQTT topic filter (may include + and # wildcards)
+	Bucket string            `json:"bucket"` // bucket template
+	Tags   map[string]string `json:"tags"`   // tags added to every line (overriding the line's own), as templates
+}
+
+// lineProtocolFor returns the first line protocol topic whose filter matches topic (or nil if there is none)
+func (s *settings) lineProtocolFor(topic string) *lineProtocolTopic {
+	for i := range s.LineProtocol {
+		if matchTopic(s.LineProtocol[i].Topic, topic) {
+			return &s.LineProtocol[i]
+		}
+	}
+	return nil
+}
+
+// validate checks the filter and that the templates only refer to topic levels the filter can match
+func (t lineProtocolTopic) validate() error {
+	if err := validateTopicFilter(t.Topic); err != nil {
+		return err
+	}
+	if t.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	templates := map[string]string{"bucket": t.Bucket}
+	for name, tmpl := range t.Tags {
+		if name == "" {
+			return errors.New("empty tag name")
+		}
+		templates["tag "+name] = tmpl
+	}
+	return validateTemplates(t.Topic, templates)
+}
+
+// buildLineProtocolPoints parses a payload of one or more lines of line protocol (nanosecond timestamps unless a rule
+// sets another unit; lines without one get the receive time). The payload is rejected as a whole if any line is
+// invalid.
+func buildLineProtocolPoints(t *lineProtocolTopic, topic string, payload []byte, at timestamps) (string, []InfluxMessage, error) {
+	levels := strings.Split(topic, "/")
+	bucket, err := expandTemplate(t.Bucket, levels)
+	if err != nil {
+		return "", nil, fmt.Errorf("bucket: %w", err)
+	}
+	extraTags := make(map[string]string, len(t.Tags))
+	for name, tmpl := range t.Tags {
+		value, err := expandTemplate(tmpl, levels)
+		if err != nil {
+			return "", nil, fmt.Errorf("tag %s: %w", name, err)
+		}
+		extraTags[name] = value
+	}
+
+	handler := protocol.NewMetricHandler()
+	handler.SetTimeFunc(func() time.Time { return at.received })
+	if at.format != nil && at.format.Unit != "" {
+		handler.SetTimePrecision(epochUnits[at.format.Unit])
+	}
+	metrics, err := protocol.NewParser(handler).Parse(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(metrics) == 0 {
+		return "", nil, errors.New("payload has no lines")
+	}
+
+	points := make([]InfluxMessage, 0, len(metrics))
+	for _, m := range metrics {
+		tags := make(map[string]string, len(m.TagList())+len(extraTags))
+		for _, tag := range m.TagList() {
+			tags[tag.Key] = tag.Value
+		}
+		for name, value := range extraTags {
+			tags[name] = value
+		}
+		fields := make(map[string]interface{}, len(m.FieldList()))
+		for _, field := range m.FieldList() {
+			fields[field.Key] = field.Value
+		}
+		points = append(points, InfluxMessage{
+			Measurement: m.Name(),
+			Tags:        tags,
+			Fields:      fields,
+			Time:        m.Time(),
+		})
+		if !at.fromPayload() {
+			points[len(points)-1].Time = at.received
+		}
+	}
+	return bucket, points, nil
+}
+
+// handleLineProtocolMessage writes the lines of line protocol published on a topic configured in line_protocol
+func (o *handler) handleLineProtocolMessage(s *settings, msg *paho.Publish, at timestamps) {
+	bucket, points, err := buildLineProtocolPoints(s.lineProtocolFor(msg.Topic), msg.Topic, msg.Payload, at)
+	if err != nil {
+		fmt.Printf("Line protocol message rejected (%s): %s\n", msg.Topic, err)
+		return
+	}
+	for _, point := range points {
+		o.emit(s, msg, bucket, point)
+	}
+}
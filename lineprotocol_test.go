@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestBuildLineProtocolPoints(t *testing.T) {
+	lp := &lineProtocolTopic{Topic: "telegraf/+/metrics", Bucket: "{2}", Tags: map[string]string{"source": "telegraf", "host": "{2}"}}
+	received := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	payload := []byte("cpu,host=ignored,cpu=cpu0 usage_idle=97.5,usage_user=1.2 1777636800000000000\n" +
+		"mem used=8127i,available_percent=61.2,swap=false\n")
+
+	bucket, points, err := buildLineProtocolPoints(lp, "telegraf/nas/metrics", payload, receivedAt(received))
+	if err != nil {
+		t.Fatalf("buildLineProtocolPoints returned error: %v", err)
+	}
+	if bucket != "nas" || len(points) != 2 {
+		t.Fatalf("expected 2 points in bucket nas, got %d in %q", len(points), bucket)
+	}
+
+	cpu, mem := points[0], points[1]
+	if cpu.Measurement != "cpu" || cpu.Tags["cpu"] != "cpu0" || cpu.Tags["host"] != "nas" || cpu.Tags["source"] != "telegraf" {
+		t.Errorf("unexpected measurement or tags: %q %v", cpu.Measurement, cpu.Tags)
+	}
+	if cpu.Fields["usage_idle"] != 97.5 || !cpu.Time.Equal(time.Unix(0, 1777636800000000000)) {
+		t.Errorf("unexpected fields or time: %v %v", cpu.Fields, cpu.Time)
+	}
+	if mem.Fields["used"] != int64(8127) || mem.Fields["swap"] != false || !mem.Time.Equal(received) {
+		t.Errorf("expected typed fields at the receive time, got %v %v", mem.Fields, mem.Time)
+	}
+}
+
+func TestBuildLineProtocolPoints_Timestamps(t *testing.T) {
+	lp := &lineProtocolTopic{Topic: "telegraf/#", Bucket: "telegraf"}
+	received := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	payload := []byte("cpu usage=1 1777636800")
+
+	_, points, err := buildLineProtocolPoints(lp, "telegraf/nas", payload, timestamps{received: received, format: &timestampFormat{Unit: "s"}})
+	if err != nil {
+		t.Fatalf("buildLineProtocolPoints returned error: %v", err)
+	}
+	if !points[0].Time.Equal(time.Unix(1777636800, 0)) {
+		t.Errorf("expected a timestamp in seconds, got %v", points[0].Time)
+	}
+
+	_, points, err = buildLineProtocolPoints(lp, "telegraf/nas", payload, timestamps{received: received, format: &timestampFormat{Source: sourceReceived}})
+	if err != nil {
+		t.Fatalf("buildLineProtocolPoints returned error: %v", err)
+	}
+	if !points[0].Time.Equal(received) {
+		t.Errorf("expected the receive time, got %v", points[0].Time)
+	}
+}
+
+func TestBuildLineProtocolPoints_RejectsInvalidPayloads(t *testing.T) {
+	lp := &lineProtocolTopic{Topic: "telegraf/#", Bucket: "telegraf"}
+	for name, payload := range map[string]string{
+		"empty":             "",
+		"json":              `{"measurement": "cpu"}`,
+		"no fields":         "cpu,host=nas",
+		"second line bad":   "cpu usage=1\nmem used=",
+		"invalid integer":   "mem used=12xi",
+		"invalid timestamp": "cpu usage=1 yesterday",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := buildLineProtocolPoints(lp, "telegraf/nas", []byte(payload), receivedAt(time.Now())); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestHandle_LineProtocol(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.LineProtocol = []lineProtocolTopic{{Topic: "lp/+", Bucket: "{2}"}}
+	h.swapSettings(s)
+
+	h.handle(&paho.Publish{Topic: "lp/p1", Payload: []byte("power,meter=main import=1.25\npower,meter=main export=0.5")})
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 2 {
+		t.Errorf("expected 2 points, got %d", report.flushed)
+	}
+	if _, ok := h.writeAPIs["p1"]; !ok {
+		t.Errorf("expected points in the p1 bucket, got buckets %v", h.writeAPIs)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
 	"github.com/eclipse/paho.golang/paho/session/state"
 	storefile "github.com/eclipse/paho.golang/paho/store/file"
 )
@@ -21,9 +22,13 @@ func main() {
 		panic(err)
 	}
 
+	s, err := loadSettings(cfg)
+	if err != nil {
+		panic(err)
+	}
+
 	// Create a handler that will deal with incoming messages
-	h := NewHandler(cfg)
-	defer h.Close()
+	h := NewHandler(cfg, s)
 
 	var sessionState *state.State
 	var cliCfg autopaho.ClientConfig
@@ -58,23 +63,99 @@ func main() {
 		panic(err)
 	}
 
+	// Keep Venus OS GX devices publishing on their N/ topics
+	go victronKeepalive(ctx, cm, h)
+
+	// Write aggregation windows whose source has stopped publishing
+	go closeIdleWindows(ctx, h)
+
+	// Handle the latest messages held back by rate limits once the limits allow
+	go releaseLimited(ctx, h)
+
+	// Save the energy totals and field types now and then, not only on shutdown
+	go saveState(ctx, h)
+
 	// Messages will be handled through the callback so we really just need to wait until a shutdown
-	// is requested
+	// is requested (SIGHUP reloads the settings file)
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 	signal.Notify(sig, syscall.SIGTERM)
-
-	<-sig
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+wait:
+	for {
+		select {
+		case <-hup:
+			reloadSettings(ctx, cfg, h, cm)
+		case <-sig:
+			break wait
+		}
+	}
 	fmt.Println("signal caught - exiting")
 
+	// Stop accepting messages, let in-flight messages finish and flush everything to InfluxDB before disconnecting
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer shutdownCancel()
+	report, err := h.Shutdown(shutdownCtx)
+	fmt.Printf("handler shutdown: %s\n", report)
+	if err != nil {
+		fmt.Printf("handler shutdown incomplete: %s\n", err)
+	}
+
 	// We could cancel the context at this point but will call Disconnect instead (this waits for autopaho to shutdown)
 	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	_ = cm.Disconnect(ctx)
 
+	// Closing the client flushes again without a deadline, so skip it if the flush already timed out
+	if err == nil {
+		h.Close()
+	}
+
 	fmt.Println("shutdown complete")
 }
 
+// reloadSettings re-reads the settings file and swaps it into the running handler. Invalid settings are rejected
+// and the current settings are kept. Subscriptions are updated to match the new topic list.
+func reloadSettings(ctx context.Context, cfg config, h *handler, cm *autopaho.ConnectionManager) {
+	if cfg.rulesFile == "" {
+		fmt.Printf("SIGHUP received but %s is not set; nothing to reload\n", envRulesFile)
+		return
+	}
+	updated, err := loadSettings(cfg)
+	if err != nil {
+		fmt.Printf("settings reload rejected, keeping current settings: %s\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	old := h.currentSettings()
+	changes := h.swapSettings(updated)
+	if len(changes) == 0 {
+		fmt.Println("settings reloaded: no changes")
+		return
+	}
+	for _, change := range changes {
+		fmt.Printf("settings reloaded: %s\n", change)
+	}
+	warnEnergyNotSaved(cfg, updated)
+
+	added, removed := diffTopics(old.Topics, updated.Topics)
+	if len(added) > 0 {
+		if err := subscribe(ctx, cm, added, cfg.qos); err != nil {
+			fmt.Printf("failed to subscribe to %v: %s\n", added, err)
+		}
+	}
+	if len(removed) > 0 {
+		if _, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: removed}); err != nil {
+			fmt.Printf("failed to unsubscribe from %v: %s\n", removed, err)
+		}
+	}
+}
+
 // logger implements the paho.Logger interface
 type logger struct {
 	prefix string
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eclipse/paho.golang/paho"
@@ -18,37 +25,270 @@ type handler struct {
 	organization string
 	client       influxdb2.Client
 	writeAPIs    map[string]api.WriteAPI
+	pending      map[string]uint64 // points handed to each write API and not yet confirmed by a handler flush
 	mu           sync.Mutex
+
+	// Write precision is a client option, so buckets written with another precision than that of client (nanoseconds)
+	// get a client of their own. A write API replaced because a reload changed its bucket's precision is retired; it
+	// is still flushed on shutdown. All guarded by mu.
+	newClient  func(precision time.Duration) influxdb2.Client
+	clients    map[time.Duration]influxdb2.Client
+	precisions map[string]time.Duration // precision of each bucket's write API
+	retired    []flushTarget
+
+	lifecycle sync.Mutex     // guards stopping and additions to inflight
+	stopping  bool           // set once Shutdown has started; new messages are rejected
+	inflight  sync.WaitGroup // handle calls currently in progress
+	rejected  atomic.Uint64  // messages refused because they arrived during shutdown
+
+	settings atomic.Pointer[settings] // reloadable settings; swapped as a whole on SIGHUP
+
+	mbusCaptured    map[string]time.Time         // capture time of the last M-Bus reading written per device (guarded by mu)
+	victronPortals  map[string]bool              // Venus OS portals seen on N/ topics, which need keepalive requests (guarded by mu)
+	fieldKinds      map[string]fieldKind         // type of the first value written to each field (guarded by mu)
+	fieldKindsFile  string                       // file fieldKinds are saved to and loaded from ("" if they are held in memory only)
+	zigbeeDevices   map[string]zigbeeDevice      // Zigbee2MQTT devices by friendly name, from bridge/devices (guarded by mu)
+	sparkplugNodes  map[string]*sparkplugNode    // Sparkplug B edge nodes by group/edge node, from births (guarded by mu)
+	seriesValues    map[string]seriesValue       // value last written to each series of a rule with a deadband (guarded by mu)
+	windows         map[string]map[int64]*window // open aggregation windows by series and UnixNano of their start (guarded by mu)
+	closedWindows   map[string]closedWindow      // last aggregation window written per series, until it expires (guarded by mu)
+	recentFields    map[string]seriesValue       // last value of each series, for computed fields with a max age (guarded by mu)
+	computedFailing map[string]bool              // computed fields whose last evaluation failed, by rule topic and name (guarded by mu)
+
+	dedup   deduplicator  // recent messages, to recognise those the broker delivers again
+	skipped atomic.Uint64 // messages skipped as duplicates or by the retained policy
+	limiter rateLimiter   // token buckets of the rate limits
+	energy  integrator    // energy totals of the integrations
 }
 
 // NewHandler creates a new output handler and opens the output file (if applicable)
-func NewHandler(cfg config) *handler {
-
-	return &handler{
+func NewHandler(cfg config, s *settings) *handler {
+	h := &handler{
 		organization: cfg.influxOrg,
-		client:       influxClient(cfg),
-		writeAPIs:    make(map[string]api.WriteAPI),
+		client:       influxClient(cfg, time.Nanosecond),
+		newClient: func(precision time.Duration) influxdb2.Client {
+			return influxClient(cfg, precision)
+		},
+		writeAPIs: make(map[string]api.WriteAPI),
+		pending:   make(map[string]uint64),
+	}
+	h.settings.Store(s)
+	if cfg.sessionFolder != "" {
+		h.dedup.file = filepath.Join(cfg.sessionFolder, dedupFileName)
+		// State saved while it was persisted is stale once it no longer is
+		if s.Dedup.persisted() {
+			if err := h.dedup.load(); err != nil {
+				fmt.Printf("Ignoring saved duplicate suppression state: %s\n", err)
+			}
+		}
+		h.energy.file = filepath.Join(cfg.sessionFolder, energyFileName)
+		if err := h.energy.load(); err != nil {
+			fmt.Printf("Ignoring saved energy totals: %s\n", err)
+		}
+		h.fieldKindsFile = filepath.Join(cfg.sessionFolder, fieldKindsFileName)
+		if err := h.loadFieldKinds(); err != nil {
+			fmt.Printf("Ignoring saved field types: %s\n", err)
+		}
+	}
+	warnEnergyNotSaved(cfg, s)
+	return h
+}
+
+// currentSettings returns the settings in force (the defaults if none have been set)
+func (o *handler) currentSettings() *settings {
+	if s := o.settings.Load(); s != nil {
+		return s
+	}
+	return defaultSettings(config{})
+}
+
+// swapSettings atomically replaces the settings and returns a description of what changed. Messages already being
+// handled complete with the settings they started with.
+func (o *handler) swapSettings(s *settings) []string {
+	old := o.settings.Swap(s)
+	if old == nil {
+		old = defaultSettings(config{})
 	}
+	return diffSettings(old, s)
 }
 
-// Close closes the influxDB client
+// Close closes the influxDB client. Shutdown should be called first so that in-flight messages are drained and
+// pending points are flushed within a deadline.
 func (o *handler) Close() {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
-	for _, writeAPI := range o.writeAPIs {
-		writeAPI.Flush()
-	}
 	o.client.Close()
+	for _, client := range o.clients {
+		client.Close()
+	}
+}
+
+// shutdownReport summarises what happened to buffered data during Shutdown
+type shutdownReport struct {
+	flushed  uint64            // points confirmed flushed to InfluxDB
+	dropped  uint64            // points whose flush did not complete before the deadline (some may have been sent by the client's periodic flush)
+	rejected uint64            // messages refused because they arrived after shutdown started
+	skipped  uint64            // messages skipped as duplicates or by the retained policy
+	limited  map[string]uint64 // messages and points dropped by rate limits, by the topic filter of the limit
+	timedOut []string          // buckets whose flush did not complete before the deadline
+}
+
+func (r shutdownReport) String() string {
+	s := fmt.Sprintf("flushed %d points, dropped %d points, rejected %d messages, skipped %d duplicate messages, limited %s messages",
+		r.flushed, r.dropped, r.rejected, r.skipped, formatLimited(r.limited))
+	if len(r.timedOut) > 0 {
+		s += fmt.Sprintf(" (flush deadline exceeded for buckets %s)", strings.Join(r.timedOut, ", "))
+	}
+	return s
+}
+
+// acquire registers a message as in flight. It returns false once Shutdown has started, in which case the
+// message must not be processed.
+func (o *handler) acquire() bool {
+	o.lifecycle.Lock()
+	defer o.lifecycle.Unlock()
+
+	if o.stopping {
+		return false
+	}
+	o.inflight.Add(1)
+	return true
+}
+
+// Shutdown stops the handler accepting new messages, waits for in-flight messages to be processed and then flushes
+// all write APIs. Both steps are bounded by ctx; points that could not be flushed in time are reported as dropped.
+// The returned error is non-nil if the deadline was exceeded.
+func (o *handler) Shutdown(ctx context.Context) (shutdownReport, error) {
+	o.lifecycle.Lock()
+	o.stopping = true
+	o.lifecycle.Unlock()
+
+	var deadlineErr error
+	drained := make(chan struct{})
+	go func() {
+		o.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		deadlineErr = fmt.Errorf("waiting for in-flight messages: %w", ctx.Err())
+	}
+
+	// Handle the messages held by rate limits, then write the aggregation windows that are still open. A released
+	// message can be held again by a series limit, so release until nothing is held.
+	for released := o.limiter.release(time.Time{}); len(released) > 0; released = o.limiter.release(time.Time{}) {
+		for _, handle := range released {
+			handle()
+		}
+	}
+	o.closeWindows(o.currentSettings(), time.Time{})
+
+	if o.currentSettings().Dedup.persisted() {
+		if err := o.dedup.save(); err != nil {
+			fmt.Printf("Failed to save duplicate suppression state: %s\n", err)
+		}
+	}
+	if err := o.energy.save(); err != nil {
+		fmt.Printf("Failed to save energy totals: %s\n", err)
+	}
+	if err := o.saveFieldKinds(); err != nil {
+		fmt.Printf("Failed to save field types: %s\n", err)
+	}
+
+	report, err := o.flush(ctx)
+	report.rejected = o.rejected.Load()
+	report.skipped = o.skipped.Load()
+	report.limited = o.limiter.counts()
+	if deadlineErr == nil {
+		deadlineErr = err
+	}
+	return report, deadlineErr
+}
+
+// flushTarget is a write API to flush and the number of points handed to it since the last flush
+type flushTarget struct {
+	bucket   string
+	writeAPI api.WriteAPI
+	pending  uint64
+}
+
+// flush flushes every write API concurrently, waiting at most until ctx is done
+func (o *handler) flush(ctx context.Context) (shutdownReport, error) {
+	o.mu.Lock()
+	targets := make([]flushTarget, 0, len(o.writeAPIs)+len(o.retired))
+	for bucket, writeAPI := range o.writeAPIs {
+		targets = append(targets, flushTarget{bucket: bucket, writeAPI: writeAPI, pending: o.pending[bucket]})
+		o.pending[bucket] = 0
+	}
+	targets = append(targets, o.retired...)
+	o.retired = nil
+	o.mu.Unlock()
+
+	var report shutdownReport
+	done := make(chan int, len(targets))
+	for i, target := range targets {
+		go func() {
+			target.writeAPI.Flush()
+			done <- i
+		}()
+	}
+
+	flushed := make([]bool, len(targets))
+	for range targets {
+		select {
+		case i := <-done:
+			report.flushed += targets[i].pending
+			flushed[i] = true
+		case <-ctx.Done():
+			for i, target := range targets {
+				if !flushed[i] {
+					report.dropped += target.pending
+					if !containsString(report.timedOut, target.bucket) {
+						report.timedOut = append(report.timedOut, target.bucket)
+					}
+				}
+			}
+			sort.Strings(report.timedOut)
+			return report, fmt.Errorf("flushing write APIs: %w", ctx.Err())
+		}
+	}
+	return report, nil
+}
+
+// clientFor returns the client that writes with the given precision
+func (o *handler) clientFor(precision time.Duration) influxdb2.Client {
+	if precision == time.Nanosecond || o.newClient == nil {
+		return o.client
+	}
+	if client, ok := o.clients[precision]; ok {
+		return client
+	}
+	if o.clients == nil {
+		o.clients = make(map[time.Duration]influxdb2.Client)
+	}
+	client := o.newClient(precision)
+	o.clients[precision] = client
+	return client
 }
 
-func (o *handler) getWriteAPI(bucket string) api.WriteAPI {
+// getWriteAPI returns the write API of bucket, creating it (or replacing it if the bucket's precision has changed)
+func (o *handler) getWriteAPI(bucket string, precision time.Duration) api.WriteAPI {
 	if writeAPI, ok := o.writeAPIs[bucket]; ok {
-		return writeAPI
+		if o.precisions[bucket] == precision {
+			return writeAPI
+		}
+		o.retired = append(o.retired, flushTarget{bucket: bucket, writeAPI: writeAPI, pending: o.pending[bucket]})
+		o.pending[bucket] = 0
 	}
 
-	writeAPI := o.client.WriteAPI(o.organization, bucket)
+	writeAPI := o.clientFor(precision).WriteAPI(o.organization, bucket)
 	o.writeAPIs[bucket] = writeAPI
+	if o.precisions == nil {
+		o.precisions = make(map[string]time.Duration)
+	}
+	o.precisions[bucket] = precision
 
 	go func(targetBucket string, errs <-chan error) {
 		for err := range errs {
@@ -59,13 +299,53 @@ func (o *handler) getWriteAPI(bucket string) api.WriteAPI {
 	return writeAPI
 }
 
-func (o *handler) writePoint(bucket string, payload InfluxMessage) {
+// emit adds the tags taken from the message's user properties, applies the mapping rule for its topic (if any),
+// including its computed and energy fields, and writes the point, unless a rate limit on its series holds it back.
+func (o *handler) emit(s *settings, msg *paho.Publish, bucket string, point InfluxMessage) {
+	point = s.addUserPropertyTags(msg, point)
+	r := s.ruleFor(msg.Topic)
+	bucket, point = r.apply(bucket, point)
+	point = o.computeFields(r, bucket, point)
+	point = o.integrate(r, bucket, point)
+	if l := s.rateLimitFor(msg.Topic, true); l != nil {
+		key := l.key(msg.Topic, pointSeries(bucket, point))
+		if !o.limiter.allow(l, key, time.Now(), func() { o.write(s, r, bucket, point) }) {
+			return
+		}
+	}
+	o.write(s, r, bucket, point)
+}
+
+// write writes a point the rule r has been applied to. The rule's aggregation sees every point; its deadband applies
+// to the points written unaggregated.
+func (o *handler) write(s *settings, r *rule, bucket string, point InfluxMessage) {
+	if r != nil && r.Aggregation != nil {
+		o.aggregate(s, r.Aggregation, bucket, point, time.Now())
+		if r.Aggregation.RawBucket == "" {
+			return
+		}
+		bucket = r.Aggregation.RawBucket
+	}
+	if r != nil {
+		point = o.applyDeadband(r.Deadband, bucket, point)
+	}
+	o.writePoint(bucket, s.Precision.forBucket(bucket), point)
+}
+
+// writePoint writes the point to bucket, truncating its time to the bucket's precision
+func (o *handler) writePoint(bucket string, precision time.Duration, payload InfluxMessage) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
-	writeAPI := o.getWriteAPI(bucket)
+	payload.Fields = o.stableFields(bucket, payload)
+	if len(payload.Fields) == 0 {
+		return
+	}
+	payload.Time = payload.Time.Truncate(precision)
+	writeAPI := o.getWriteAPI(bucket, precision)
 	p := influxdb2.NewPoint(payload.Measurement, payload.Tags, payload.Fields, payload.Time)
 	writeAPI.WritePoint(p)
+	o.pending[bucket]++
 }
 
 func splitTopic(topic string) (string, string, error) {
@@ -80,14 +360,14 @@ func splitTopic(topic string) (string, string, error) {
 }
 
 type genericPayloadMessage struct {
-	Value     float64 `json:"value"`
-	Timestamp int64   `json:"timestamp"`
+	Value     interface{}     `json:"value"`
+	Timestamp json.RawMessage `json:"timestamp"`
 }
 
 type sensorMessage struct {
-	Unit      string    `json:"unit"`
-	Value     float64   `json:"value"`
-	Timestamp time.Time `json:"timestamp"`
+	Unit      string          `json:"unit"`
+	Value     interface{}     `json:"value"`
+	Timestamp json.RawMessage `json:"timestamp"`
 }
 
 type InfluxMessage struct {
@@ -97,115 +377,133 @@ type InfluxMessage struct {
 	Time        time.Time              `json:"time"`
 }
 
-func toInfluxMessage(measurement string, location string, sensorId string, message sensorMessage) InfluxMessage {
+func toInfluxMessage(cfg valueSettings, measurement string, location string, sensorId string, message sensorMessage, timestamp time.Time) InfluxMessage {
+	tags := map[string]string{
+		"unit":     message.Unit,
+		"location": location,
+	}
+	fields := make(map[string]interface{})
+	flattenValue(cfg, sensorId, message.Value, fields, tags)
 	return InfluxMessage{
 		Measurement: measurement,
-		Tags: map[string]string{
-			"unit":     message.Unit,
-			"location": location,
-		},
-		Fields: map[string]interface{}{
-			sensorId: message.Value,
-		},
-		Time: message.Timestamp,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        timestamp,
 	}
 }
 
 type solarMessage struct {
 	Model     string                 `json:"model"`
 	Data      map[string]interface{} `json:"data"`
-	Timestamp float64                `json:"timestamp"`
+	Timestamp json.RawMessage        `json:"timestamp"`
 	Source    string                 `json:"source"`
 }
 
-// solarTagKeys is the explicit allowlist of data fields that should be stored as InfluxDB tags.
-var solarTagKeys = map[string]bool{
-	"status":           true,
-	"model_id":         true,
-	"model_length":     true,
-	"status_vendor_16": true,
-	"status_vendor_32": true,
-	"status_code":      true,
+// classifySolarField maps a data field key to its target InfluxDB bucket using the configured field rules.
+// Returns "tag" for fields in the configured tag allowlist that should be stored as tags instead of measurement fields.
+// Returns the configured unknown bucket (by default "", meaning the field is skipped) if no rule matches.
+func classifySolarField(cfg solarSettings, key string) string {
+	if cfg.tagKeys[key] {
+		return "tag"
+	}
+	for _, r := range cfg.Fields {
+		if r.matches(key) {
+			return r.Bucket
+		}
+	}
+	return cfg.UnknownBucket
 }
 
-// classifySolarField maps a data field key to its target InfluxDB bucket.
-// Returns "tag" for fields that should be stored as tags instead of measurement fields.
-// Returns "" for unknown fields that should be skipped.
-func classifySolarField(key string) string {
-	if solarTagKeys[key] {
-		return "tag"
+// applySunSpecScaleFactors returns the solar data with SunSpec scale factors applied. A field named <name>_sf is
+// the power of ten that the raw value of <name> and <name>_* must be multiplied by (the longest matching name wins).
+// Scale factors are not returned as fields. Scaled fields holding a "not implemented" sentinel, or whose scale factor
+// holds one, are returned as nil so they are treated as missing.
+func applySunSpecScaleFactors(cfg solarSettings, data map[string]interface{}) map[string]interface{} {
+	scaleFactors := make(map[string]interface{})
+	for key, val := range data {
+		if strings.HasSuffix(key, "_sf") {
+			scaleFactors[strings.TrimSuffix(key, "_sf")] = val
+		}
+	}
+	if len(scaleFactors) == 0 {
+		return data
 	}
-	switch {
-	case strings.HasSuffix(key, "_wh"):
-		return "latest_energy"
-	case strings.HasSuffix(key, "_w") || strings.HasSuffix(key, "_va") ||
-		strings.HasSuffix(key, "_var") || strings.HasSuffix(key, "_pct"):
-		return "latest_energy_current"
-	case strings.HasPrefix(key, "ac_current_") || strings.HasPrefix(key, "ac_voltage_") ||
-		strings.HasPrefix(key, "dc_current_") || strings.HasPrefix(key, "dc_voltage_") ||
-		strings.HasSuffix(key, "_hz"):
-		return "latest_voltage_current"
-	case strings.HasPrefix(key, "temp_"):
-		return "sensors"
-	default:
-		return ""
-	}
-}
-
-func transformSolarValue(key string, val interface{}) (string, interface{}) {
-	switch {
-	case strings.HasSuffix(key, "_wh"):
-		// convert watt-hour values to kilowatt-hours and rename accordingly
-		if num, ok := val.(float64); ok {
-			return strings.TrimSuffix(key, "_wh") + "_kwh", num / 1000
+
+	result := make(map[string]interface{}, len(data))
+	for key, val := range data {
+		if strings.HasSuffix(key, "_sf") {
+			continue
 		}
-	case strings.HasSuffix(key, "_w"):
-		// convert watt values to kilowatts and rename accordingly
-		if num, ok := val.(float64); ok {
-			return strings.TrimSuffix(key, "_w") + "_kw", num / 1000
+		name := ""
+		for candidate := range scaleFactors {
+			if (key == candidate || strings.HasPrefix(key, candidate+"_")) && len(candidate) > len(name) {
+				name = candidate
+			}
+		}
+		if name == "" || val == nil {
+			result[key] = val
+			continue
+		}
+
+		raw, ok := toFloat(val)
+		if !ok {
+			result[key] = val
+			continue
+		}
+		sf, ok := toFloat(scaleFactors[name])
+		if !ok || cfg.isNotImplemented(raw) || cfg.isNotImplemented(sf) {
+			result[key] = nil
+			continue
+		}
+		if sf < 0 {
+			result[key] = raw / math.Pow10(int(-sf))
+		} else {
+			result[key] = raw * math.Pow10(int(sf))
 		}
 	}
-	return key, val
+	return result
 }
 
+// solarTimestamps is the format of SolarEdge timestamps: seconds since the epoch with a fraction
+var solarTimestamps = timestampFormat{Unit: "s"}
+
 // buildSolarPoints parses a raw solar MQTT payload and returns a map of
 // bucket name → InfluxMessage ready for writing. Only buckets with at least
 // one field are included in the result.
-func buildSolarPoints(payload []byte) (map[string]InfluxMessage, error) {
+func buildSolarPoints(cfg solarSettings, payload []byte, at timestamps) (map[string]InfluxMessage, error) {
 	var solar solarMessage
 	if err := json.Unmarshal(payload, &solar); err != nil {
 		return nil, err
 	}
 
-	sec := int64(solar.Timestamp)
-	nsec := int64((solar.Timestamp - float64(sec)) * 1e9)
-	timestamp := time.Unix(sec, nsec)
+	timestamp, err := at.parse(solar.Timestamp, solarTimestamps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %w", err)
+	}
 
 	tags := map[string]string{
 		"model":  solar.Model,
 		"source": solar.Source,
 	}
 
-	buckets := map[string]map[string]interface{}{
-		"latest_energy":          {},
-		"latest_energy_current":  {},
-		"latest_voltage_current": {},
-		"sensors":                {},
-	}
+	buckets := make(map[string]map[string]interface{})
 
-	for key, val := range solar.Data {
+	for key, val := range applySunSpecScaleFactors(cfg, solar.Data) {
 		if val == nil {
 			continue
 		}
-		bucket := classifySolarField(key)
+		bucket := classifySolarField(cfg, key)
 		switch bucket {
 		case "tag":
 			tags[key] = fmt.Sprintf("%v", val)
 		case "":
 			fmt.Printf("Unknown solar field %q, skipping\n", key)
 		default:
-			newKey, transformValue := transformSolarValue(key, val)
-			buckets[bucket][newKey] = transformValue
+			if buckets[bucket] == nil {
+				buckets[bucket] = make(map[string]interface{})
+			}
+			newKey, converted, _ := convertField(cfg.Conversions, key, val, "")
+			buckets[bucket][newKey] = converted
 		}
 	}
 
@@ -225,7 +523,7 @@ func buildSolarPoints(payload []byte) (map[string]InfluxMessage, error) {
 }
 
 func handleSolarMessage(msg *paho.Publish, client influxdb2.Client, organization string) {
-	points, err := buildSolarPoints(msg.Payload)
+	points, err := buildSolarPoints(defaultSettings(config{}).Solar, msg.Payload, receivedAt(time.Now()))
 	if err != nil {
 		fmt.Printf("Solar message could not be parsed (%s): %s", msg.Payload, err)
 		return
@@ -238,105 +536,275 @@ func handleSolarMessage(msg *paho.Publish, client influxdb2.Client, organization
 	}
 }
 
-func (o *handler) handleSolarMessage(msg *paho.Publish) {
-	points, err := buildSolarPoints(msg.Payload)
+func (o *handler) handleSolarMessage(s *settings, msg *paho.Publish, at timestamps) {
+	points, err := buildSolarPoints(s.Solar, msg.Payload, at)
 	if err != nil {
 		fmt.Printf("Solar message could not be parsed (%s): %s", msg.Payload, err)
 		return
 	}
 
 	for bucket, influxMsg := range points {
-		o.writePoint(bucket, influxMsg)
+		o.emit(s, msg, bucket, influxMsg)
 	}
 }
 
-func buildVictronPoint(topic string, payload []byte) (string, InfluxMessage, error) {
-	var victronMessage genericPayloadMessage
-	if err := json.Unmarshal(payload, &victronMessage); err != nil {
-		return "", InfluxMessage{}, fmt.Errorf("topic %q: %w", topic, err)
+// handleP1Message writes a P1 reading to the bucket named by the second topic level. The payload is either a raw
+// DSMR telegram or an InfluxMessage encoded as JSON.
+func (o *handler) handleP1Message(s *settings, msg *paho.Publish, at timestamps) {
+	_, subTopic, err := splitTopic(msg.Topic)
+	if err != nil {
+		fmt.Printf("Error splitting topic: %s", err)
+		return
+	}
+
+	if isP1Telegram(msg.Payload) {
+		p1Message, readings, err := buildP1Points(s.P1, msg.Payload, at)
+		if err != nil {
+			fmt.Printf("P1 telegram could not be parsed (%s): %s\n", msg.Topic, err)
+			return
+		}
+		if len(p1Message.Fields) > 0 {
+			o.emit(s, msg, subTopic, p1Message)
+		}
+		for _, reading := range readings {
+			// The meter repeats the last M-Bus reading in every telegram until the device reports again
+			if o.mbusReadingIsNew(subTopic, reading) {
+				point := reading.point()
+				if !at.fromPayload() {
+					point.Time = at.received
+				}
+				o.emit(s, msg, subTopic, point)
+			}
+		}
+		return
+	}
+
+	var p1Message struct {
+		InfluxMessage
+		Time json.RawMessage `json:"time"` // replaces InfluxMessage.Time so that any timestamp format is accepted
+	}
+	if err := json.Unmarshal(msg.Payload, &p1Message); err != nil {
+		fmt.Printf("Message could not be parsed (%s): %s", msg.Payload, err)
+		return
 	}
+	timestamp, err := at.parse(p1Message.Time, timestampFormat{})
+	if err != nil {
+		fmt.Printf("Message on topic %s has an invalid time: %s\n", msg.Topic, err)
+		return
+	}
+	p1Message.InfluxMessage.Time = timestamp
+	o.emit(s, msg, subTopic, p1Message.InfluxMessage)
+}
+
+// mbusReadingIsNew records the capture time of an M-Bus reading and reports whether it is newer than the last
+// reading seen from the same device
+func (o *handler) mbusReadingIsNew(bucket string, reading mbusReading) bool {
+	key := bucket + "/" + reading.channel + "/" + reading.equipmentID
 
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mbusCaptured == nil {
+		o.mbusCaptured = make(map[string]time.Time)
+	}
+	if last, ok := o.mbusCaptured[key]; ok && !reading.captured.After(last) {
+		return false
+	}
+	o.mbusCaptured[key] = reading.captured
+	return true
+}
+
+// errNoVictronValue is returned for Victron messages that carry no value (Venus OS publishes an empty payload or a
+// null value when a path becomes invalid); such messages are ignored
+var errNoVictronValue = errors.New("message has no value")
+
+// victronTopic holds the parts of a Victron topic: <prefix>/<portal>/<service>/<instance>/<path>
+type victronTopic struct {
+	portal   string
+	service  string
+	instance string
+	path     string // "value" if the topic has no path
+}
+
+// parseVictronMessage splits a Victron topic and decodes its payload
+func parseVictronMessage(topic string, payload []byte) (victronTopic, genericPayloadMessage, error) {
 	topicParts := strings.Split(topic, "/")
-	if len(topicParts) < 3 || topicParts[0] != "victron" {
-		return "", InfluxMessage{}, fmt.Errorf("topic is not in the correct format: %s", topic)
+	if len(topicParts) < 3 || (topicParts[0] != "victron" && topicParts[0] != "N") {
+		return victronTopic{}, genericPayloadMessage{}, fmt.Errorf("topic is not in the correct format: %s", topic)
+	}
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return victronTopic{}, genericPayloadMessage{}, errNoVictronValue
 	}
 
-	bucket := topicParts[0]
-	vrm_portal_id := topicParts[1]
-	serviceType := topicParts[2]
-	deviceInstance := ""
-	if len(topicParts) > 3 {
-		deviceInstance = topicParts[3]
+	// Decode numbers as json.Number so that integers can be told apart from floats
+	var victronMessage genericPayloadMessage
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&victronMessage); err != nil {
+		return victronTopic{}, genericPayloadMessage{}, fmt.Errorf("topic %q: %w", topic, err)
+	}
+	if victronMessage.Value == nil {
+		return victronTopic{}, genericPayloadMessage{}, errNoVictronValue
 	}
 
-	fieldKey := "value"
+	parsed := victronTopic{portal: topicParts[1], service: topicParts[2], path: "value"}
+	if len(topicParts) > 3 {
+		parsed.instance = topicParts[3]
+	}
 	if len(topicParts) > 4 {
-		fieldKey = strings.Join(topicParts[4:], "/")
+		parsed.path = strings.Join(topicParts[4:], "/")
+	}
+	return parsed, victronMessage, nil
+}
+
+// victronTimestamps is the format of timestamps added by republishers: milliseconds since the epoch
+var victronTimestamps = timestampFormat{Unit: "ms"}
+
+// time returns the message timestamp, or the receive time if the message has none (Venus OS payloads carry no
+// timestamp)
+func (m genericPayloadMessage) time(at timestamps) (time.Time, error) {
+	return at.parse(m.Timestamp, victronTimestamps)
+}
+
+// buildVictronPoint decodes a message published by Venus OS (N/<portal>/<service>/<instance>/<path>) or by a
+// republisher (victron/<portal>/<service>/<instance>/<path>). Object and array values are flattened into one field
+// per leaf, named after the path and the keys/indexes leading to it; cfg decides how numbers and strings are stored.
+func buildVictronPoint(cfg valueSettings, topic string, payload []byte, at timestamps) (string, InfluxMessage, error) {
+	parsed, victronMessage, err := parseVictronMessage(topic, payload)
+	if err != nil {
+		return "", InfluxMessage{}, err
+	}
+
+	tags := map[string]string{
+		"vrm_portal_id":   parsed.portal,
+		"device_instance": parsed.instance,
+	}
+	fields := make(map[string]interface{})
+	flattenValue(cfg, parsed.path, victronMessage.Value, fields, tags)
+	if len(fields) == 0 {
+		return "", InfluxMessage{}, fmt.Errorf("topic %q: value %v has no data to store as a field", topic, victronMessage.Value)
 	}
 
+	timestamp, err := victronMessage.time(at)
+	if err != nil {
+		return "", InfluxMessage{}, fmt.Errorf("topic %q: invalid timestamp: %w", topic, err)
+	}
 	point := InfluxMessage{
-		Measurement: serviceType,
-		Tags: map[string]string{
-			"vrm_portal_id":   vrm_portal_id,
-			"device_instance": deviceInstance,
-		},
-		Fields: map[string]interface{}{
-			fieldKey: victronMessage.Value,
-		},
-		Time: time.UnixMilli(victronMessage.Timestamp),
+		Measurement: parsed.service,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        timestamp,
 	}
 
-	return bucket, point, nil
+	return "victron", point, nil
 }
 
-// handle is called when a message is received
-func (o *handler) handle(msg *paho.Publish) {
-	if strings.HasPrefix(msg.Topic, "solaredge/") {
-		o.handleSolarMessage(msg)
-	} else if strings.Contains(msg.Topic, "p1") {
-		var p1Message InfluxMessage
-		err := json.Unmarshal(msg.Payload, &p1Message)
-		if err != nil {
-			fmt.Printf("Message could not be parsed (%s): %s", msg.Payload, err)
+// handleVictronMessage writes a single Victron value to the victron bucket
+func (o *handler) handleVictronMessage(s *settings, msg *paho.Publish, at timestamps) {
+	for _, suffix := range s.Victron.SkipSuffixes {
+		if strings.HasSuffix(msg.Topic, suffix) {
+			return
 		}
-		_, subTopic, err := splitTopic(msg.Topic)
-		if err != nil {
-			fmt.Printf("Error splitting topic: %s", err)
+	}
+	if strings.HasPrefix(msg.Topic, "N/") {
+		o.victronPortalSeen(strings.Split(msg.Topic, "/")[1])
+	}
+	if strings.HasSuffix(msg.Topic, "/Batteries") {
+		bucket, points, err := buildVictronBatteryPoints(s.Values, msg.Topic, msg.Payload, at)
+		if errors.Is(err, errNoVictronValue) {
 			return
 		}
-		o.writePoint(subTopic, p1Message)
-	} else if strings.Contains(msg.Topic, "sensors") {
-		var sensorMessage sensorMessage
-		err := json.Unmarshal(msg.Payload, &sensorMessage)
 		if err != nil {
-			fmt.Printf("Message could not be parsed (%s): %s", msg.Payload, err)
-		}
-		if sensorMessage.Timestamp.IsZero() {
-			sensorMessage.Timestamp = time.Now()
-		}
-
-		splittedTopic := strings.Split(msg.Topic, "/")
-		if len(splittedTopic) != 4 {
-			fmt.Printf("Topic is not in the correct format: %s", msg.Topic)
+			fmt.Printf("Victron battery message could not be parsed (%s): %s\n", msg.Topic, err)
 			return
 		}
-		bucket, measurement, location, sensorId := splittedTopic[0], splittedTopic[1], splittedTopic[2], splittedTopic[3]
+		for _, point := range points {
+			o.emit(s, msg, bucket, point)
+		}
+		return
+	}
+	bucket, victronInfluxMessage, err := buildVictronPoint(s.Values, msg.Topic, msg.Payload, at)
+	if errors.Is(err, errNoVictronValue) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Victron message could not be parsed (%s): %s", msg.Payload, err)
+		return
+	}
+	o.emit(s, msg, bucket, victronInfluxMessage)
+}
 
-		sensorInfluxMessage := toInfluxMessage(measurement, location, sensorId, sensorMessage)
+// handle is called when a message is received. It returns false if the message was rejected because the handler is
+// shutting down, in which case it must not be acknowledged.
+func (o *handler) handle(msg *paho.Publish) bool {
+	if !o.acquire() {
+		o.rejected.Add(1)
+		fmt.Printf("Shutting down, message on topic %s rejected\n", msg.Topic)
+		return false
+	}
+	defer o.inflight.Done()
 
-		o.writePoint(bucket, sensorInfluxMessage)
-	} else if strings.HasPrefix(msg.Topic, "victron/") {
-		if !strings.HasSuffix(msg.Topic, "Batteries") && !strings.HasSuffix(msg.Topic, "Network/Services") {
-			bucket, victronInfluxMessage, err := buildVictronPoint(msg.Topic, msg.Payload)
-			if err != nil {
-				fmt.Printf("Victron message could not be parsed (%s): %s", msg.Payload, err)
-				return
-			}
-			o.writePoint(bucket, victronInfluxMessage)
+	s := o.currentSettings()
+	received := time.Now()
+	if o.dedup.skip(s.Dedup, msg, received) {
+		o.skipped.Add(1)
+		return true
+	}
+	if l := s.rateLimitFor(msg.Topic, false); l != nil {
+		if !o.limiter.allow(l, l.key(msg.Topic, ""), received, func() { o.decode(s, msg, received) }) {
+			return true
 		}
+	}
+	o.decode(s, msg, received)
+	return true
+}
 
-	} else {
+// decode decodes a message received at time received and hands it to the decoder for its topic
+func (o *handler) decode(s *settings, msg *paho.Publish, received time.Time) {
+	decoded, format, err := decodePayload(msg, s.payloadFormat(msg))
+	if err != nil {
+		fmt.Printf("Message on topic %s rejected: %s\n", msg.Topic, err)
+		return
+	}
+	msg = decoded
+	d := findDecoder(s, msg.Topic, format)
+	if d == nil && format != "" {
+		fmt.Printf("No decoder for %s payloads on topic %s\n", format, msg.Topic)
+		return
+	}
+	if d == nil {
 		fmt.Printf("Unknown topic: %s", msg.Topic)
 		return
 	}
+	d.handle(o, s, msg, s.timestampsFor(msg.Topic, received))
+}
+
+// handleSensorMessage writes a single sensor value published on <bucket>/<measurement>/<location>/<sensor id>
+func (o *handler) handleSensorMessage(s *settings, msg *paho.Publish, at timestamps) {
+	var sensorMessage sensorMessage
+	dec := json.NewDecoder(bytes.NewReader(msg.Payload))
+	dec.UseNumber()
+	err := dec.Decode(&sensorMessage)
+	if err != nil {
+		fmt.Printf("Message could not be parsed (%s): %s", msg.Payload, err)
+	}
+	timestamp, err := at.parse(sensorMessage.Timestamp, timestampFormat{})
+	if err != nil {
+		fmt.Printf("Message on topic %s has an invalid timestamp: %s\n", msg.Topic, err)
+		return
+	}
+
+	splittedTopic := strings.Split(msg.Topic, "/")
+	if len(splittedTopic) != 4 {
+		fmt.Printf("Topic is not in the correct format: %s", msg.Topic)
+		return
+	}
+	bucket, measurement, location, sensorId := splittedTopic[0], splittedTopic[1], splittedTopic[2], splittedTopic[3]
+
+	sensorInfluxMessage := toInfluxMessage(s.Values, measurement, location, sensorId, sensorMessage, timestamp)
+	if len(sensorInfluxMessage.Fields) == 0 {
+		fmt.Printf("Message on topic %s has no value to store as a field\n", msg.Topic)
+		return
+	}
+
+	o.emit(s, msg, bucket, sensorInfluxMessage)
 }
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/eclipse/paho.golang/paho"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
 )
 
 func TestBuildVictronPoint_ExampleMessages(t *testing.T) {
@@ -16,7 +26,7 @@ func TestBuildVictronPoint_ExampleMessages(t *testing.T) {
 		expectedPortal string
 		expectedDevice string
 		expectedField  string
-		expectedValue  float64
+		expectedValue  interface{}
 		expectedMillis int64
 	}{
 		{
@@ -28,7 +38,7 @@ func TestBuildVictronPoint_ExampleMessages(t *testing.T) {
 			expectedPortal: "a7f3c19de82b",
 			expectedDevice: "40",
 			expectedField:  "Ac/L3/Power",
-			expectedValue:  -1393,
+			expectedValue:  int64(-1393),
 			expectedMillis: 1782637540236,
 		},
 		{
@@ -76,14 +86,14 @@ func TestBuildVictronPoint_ExampleMessages(t *testing.T) {
 			expectedPortal: "a7f3c19de82b",
 			expectedDevice: "",
 			expectedField:  "value",
-			expectedValue:  1782637540,
+			expectedValue:  int64(1782637540),
 			expectedMillis: 1782637540438,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bucket, point, err := buildVictronPoint(tt.topic, tt.payload)
+			bucket, point, err := buildVictronPoint(defaultSettings(config{}).Values, tt.topic, tt.payload, receivedAt(time.Now()))
 			if err != nil {
 				t.Fatalf("buildVictronPoint returned error: %v", err)
 			}
@@ -116,17 +126,18 @@ func TestBuildVictronPoint_ExampleMessages(t *testing.T) {
 }
 
 func TestBuildVictronPoint_InvalidInput(t *testing.T) {
-	if _, _, err := buildVictronPoint("victron/too-short", []byte(`{"value": 1, "timestamp": 2}`)); err == nil {
+	if _, _, err := buildVictronPoint(defaultSettings(config{}).Values, "victron/too-short", []byte(`{"value": 1, "timestamp": 2}`), receivedAt(time.Now())); err == nil {
 		t.Fatal("expected error for malformed topic")
 	}
 
-	if _, _, err := buildVictronPoint("victron/a/grid/1/x", []byte(`not-json`)); err == nil {
+	if _, _, err := buildVictronPoint(defaultSettings(config{}).Values, "victron/a/grid/1/x", []byte(`not-json`), receivedAt(time.Now())); err == nil {
 		t.Fatal("expected error for invalid payload")
 	}
 }
 
-func TestHandle_SkipsVictronTopics(t *testing.T) {
-	h := &handler{organization: "test-org", client: nil}
+func TestHandle_DecodesStructuredVictronTopics(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
 	msg := &paho.Publish{
 		Topic: "victron/f29b4d80a6ce/system/0/Batteries",
 		Payload: []byte(`{
@@ -246,12 +257,212 @@ func TestHandle_SkipsVictronTopics(t *testing.T) {
 }]}`),
 	}
 
+	h.handle(msg)
+	h.handle(msg2)
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 2 {
+		t.Errorf("expected a battery point and a flattened services point, got %d points", report.flushed)
+	}
+}
+
+func TestHandle_SkipsConfiguredVictronSuffixes(t *testing.T) {
+	h := &handler{organization: "test-org", client: nil}
+	s := defaultSettings(config{})
+	s.Victron.SkipSuffixes = []string{"Batteries"}
+	h.swapSettings(s)
+
 	defer func() {
 		if r := recover(); r != nil {
-			t.Fatalf("expected skipped topics to not write, but handle panicked: %v", r)
+			t.Fatalf("expected skipped topic to not write, but handle panicked: %v", r)
 		}
 	}()
 
-	h.handle(msg)
-	h.handle(msg2)
+	h.handle(&paho.Publish{
+		Topic:   "victron/f29b4d80a6ce/system/0/Batteries",
+		Payload: []byte(`{"value": [{"id": "com.victronenergy.battery.socketcan_vecan1", "soc": 53}]}`),
+	})
+}
+
+// newTestInfluxHandler returns a handler writing to an httptest server that answers every write after delay
+func newTestInfluxHandler(t *testing.T, delay time.Duration) *handler {
+	t.Helper()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-release:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.Close()
+	})
+
+	return newTestHandler(srv.URL)
+}
+
+// newRecordingHandler returns a handler writing to an httptest server that records the lines written, and a function
+// returning them by "<bucket> <precision>"
+func newRecordingHandler(t *testing.T) (*handler, func() map[string][]string) {
+	t.Helper()
+	var mu sync.Mutex
+	writes := make(map[string][]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		key := r.URL.Query().Get("bucket") + " " + r.URL.Query().Get("precision")
+		mu.Lock()
+		writes[key] = append(writes[key], strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	return newTestHandler(srv.URL), func() map[string][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return writes
+	}
+}
+
+// newTestHandler returns a handler writing to the InfluxDB server at url
+func newTestHandler(url string) *handler {
+	newClient := func(precision time.Duration) influxdb2.Client {
+		opts := influxdb2.DefaultOptions().SetBatchSize(100).SetFlushInterval(60000).SetMaxRetries(0).SetPrecision(precision)
+		return influxdb2.NewClientWithOptions(url, "token", opts)
+	}
+	return &handler{
+		organization: "test-org",
+		client:       newClient(time.Nanosecond),
+		newClient:    newClient,
+		writeAPIs:    make(map[string]api.WriteAPI),
+		pending:      make(map[string]uint64),
+	}
+}
+
+func TestShutdown_FlushesPendingPoints(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+
+	h.handle(&paho.Publish{
+		Topic:   "victron/a7f3c19de82b/grid/40/Ac/L3/Power",
+		Payload: []byte(`{"value": -1393, "timestamp": 1782637540236}`),
+	})
+	h.handle(&paho.Publish{
+		Topic:   "sensors/temperature/livingroom/t1",
+		Payload: []byte(`{"unit": "C", "value": 21.5}`),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, err := h.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 2 || report.dropped != 0 {
+		t.Errorf("expected 2 flushed and 0 dropped points, got %s", report)
+	}
+}
+
+func TestShutdown_RejectsMessagesAfterStop(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+
+	if _, err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	accepted := h.handle(&paho.Publish{
+		Topic:   "victron/a7f3c19de82b/grid/40/Ac/L3/Power",
+		Payload: []byte(`{"value": -1393, "timestamp": 1782637540236}`),
+	})
+
+	if accepted {
+		t.Error("expected the message not to be accepted, so that it is not acknowledged")
+	}
+	if got := h.rejected.Load(); got != 1 {
+		t.Errorf("expected 1 rejected message, got %d", got)
+	}
+	if len(h.writeAPIs) != 0 {
+		t.Errorf("expected no writes after shutdown, got write APIs for %d buckets", len(h.writeAPIs))
+	}
+}
+
+func TestShutdown_ReportsDroppedPointsOnDeadline(t *testing.T) {
+	h := newTestInfluxHandler(t, time.Minute)
+
+	h.handle(&paho.Publish{
+		Topic:   "victron/a7f3c19de82b/grid/40/Ac/L3/Power",
+		Payload: []byte(`{"value": -1393, "timestamp": 1782637540236}`),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := h.Shutdown(ctx)
+	if err == nil {
+		t.Fatal("expected deadline error from Shutdown")
+	}
+	if report.dropped != 1 || report.flushed != 0 {
+		t.Errorf("expected 1 dropped and 0 flushed points, got %s", report)
+	}
+	if len(report.timedOut) != 1 || report.timedOut[0] != "victron" {
+		t.Errorf("expected victron bucket to time out, got %v", report.timedOut)
+	}
+}
+
+func TestWritePoint_BucketPrecision(t *testing.T) {
+	h, writes := newRecordingHandler(t)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.Precision = precisionSettings{Default: "ms", Buckets: map[string]string{"sensors": "s"}}
+	h.swapSettings(s)
+
+	at := time.Unix(1782637540, 987654321)
+	point := InfluxMessage{Measurement: "m", Fields: map[string]interface{}{"v": 1.5}, Time: at}
+	msg := &paho.Publish{Topic: "sensors/temperature/livingroom/t1"}
+	h.emit(s, msg, "sensors", point)
+	h.emit(s, msg, "victron", point)
+
+	// A reload changes the precision of a bucket that has already been written to
+	reloaded := defaultSettings(config{topic: "#"})
+	reloaded.Precision = precisionSettings{Default: "ns", Buckets: map[string]string{"victron": "us"}}
+	h.swapSettings(reloaded)
+	h.emit(reloaded, msg, "victron", point)
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 3 {
+		t.Errorf("expected 3 points flushed, got %d", report.flushed)
+	}
+
+	expected := map[string][]string{
+		"sensors s":  {"m v=1.5 1782637540"},
+		"victron ms": {"m v=1.5 1782637540987"},
+		"victron us": {"m v=1.5 1782637540987654"},
+	}
+	if got := writes(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected writes %v, got %v", expected, got)
+	}
+}
+
+func TestPrecisionSettings_ForBucket(t *testing.T) {
+	p := precisionSettings{Default: "ms", Buckets: map[string]string{"p1": "s", "solar": "us"}}
+	tests := map[string]time.Duration{
+		"p1":      time.Second,
+		"solar":   time.Microsecond,
+		"victron": time.Millisecond,
+	}
+	for bucket, expected := range tests {
+		if got := p.forBucket(bucket); got != expected {
+			t.Errorf("forBucket(%q) = %v, want %v", bucket, got, expected)
+		}
+	}
+	if got := (precisionSettings{}).forBucket("p1"); got != time.Nanosecond {
+		t.Errorf("expected nanoseconds without settings, got %v", got)
+	}
 }
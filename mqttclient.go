@@ -70,11 +70,7 @@ func createClient(cfg config, sessionState *state.State, h *handler) autopaho.Cl
 		ReconnectBackoff:              autopaho.NewConstantBackoff(cfg.connectRetryDelay),
 		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
 			fmt.Println("mqtt connection up")
-			if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{
-				Subscriptions: []paho.SubscribeOptions{
-					{Topic: cfg.topic, QoS: cfg.qos},
-				},
-			}); err != nil {
+			if err := subscribe(context.Background(), cm, h.currentSettings().Topics, cfg.qos); err != nil {
 				fmt.Printf("failed to subscribe (%s). This is likely to mean no messages will be received.", err)
 				return
 			}
@@ -85,9 +81,16 @@ func createClient(cfg config, sessionState *state.State, h *handler) autopaho.Cl
 		ClientConfig: paho.ClientConfig{
 			ClientID: cfg.clientID,
 			Session:  sessionState,
+			// Messages rejected during shutdown are not acknowledged, so that the broker delivers them again
+			EnableManualAcknowledgment: true,
 			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
 				func(pr paho.PublishReceived) (bool, error) {
-					h.handle(pr.Packet)
+					if !h.handle(pr.Packet) {
+						return true, nil
+					}
+					if err := pr.Client.Ack(pr.Packet); err != nil {
+						fmt.Printf("failed to acknowledge message on topic %s: %s\n", pr.Packet.Topic, err)
+					}
 					return true, nil
 				}},
 			OnClientError: func(err error) { fmt.Printf("client error: %s\n", err) },
@@ -103,3 +106,13 @@ func createClient(cfg config, sessionState *state.State, h *handler) autopaho.Cl
 
 	return cliCfg
 }
+
+// subscribe subscribes to each of the topic filters with the given QoS
+func subscribe(ctx context.Context, cm *autopaho.ConnectionManager, topics []string, qos byte) error {
+	subscriptions := make([]paho.SubscribeOptions, 0, len(topics))
+	for _, topic := range topics {
+		subscriptions = append(subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	_, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: subscriptions})
+	return err
+}
@@ -155,6 +155,10 @@ func TestCreateMQTTClient(t *testing.T) {
 		t.Errorf("expected clientID to be %s, got %s", cfg.clientID, clientCfg.ClientConfig.ClientID) //nolint:staticcheck
 	}
 
+	if !clientCfg.ClientConfig.EnableManualAcknowledgment { //nolint:staticcheck
+		t.Error("expected manual acknowledgment, so that messages rejected during shutdown are not acknowledged")
+	}
+
 	if len(clientCfg.ClientConfig.OnPublishReceived) != 1 { //nolint:staticcheck
 		t.Errorf("expected 1 OnPublishReceived handler, got %d", len(clientCfg.ClientConfig.OnPublishReceived))
 	}
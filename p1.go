@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DSMR 4/5 (and Belgian eMUCs) P1 telegrams look like:
+//
+//	/ISk5\2MT382-1000
+//
+//	1-3:0.2.8(50)
+//	0-0:1.0.0(101209113020W)
+//	1-0:1.8.1(123456.789*kWh)
+//	...
+//	!EF2F
+//
+// The header starts with '/', every following line holds an OBIS reference followed by one or more values in
+// parentheses and the telegram ends with '!' and a CRC16 over everything from '/' up to and including '!'.
+
+// p1ValueKind describes how the value of an OBIS object is stored
+type p1ValueKind int
+
+const (
+	p1Float        p1ValueKind = iota // numeric value (units are dropped, the field name says what it is)
+	p1Integer                         // counter or state stored as an integer
+	p1Tag                             // identifier stored as a tag
+	p1HexTag                          // hex encoded text stored as a tag
+	p1StampedFloat                    // (timestamp)(value) pair where only the value is stored
+)
+
+// p1Object maps an OBIS reference to the name it is stored under
+type p1Object struct {
+	name string
+	kind p1ValueKind
+}
+
+// p1Objects lists the OBIS references decoded from the telegram; anything else is ignored
+var p1Objects = map[string]p1Object{
+	"1-3:0.2.8":   {"dsmr_version", p1Tag},
+	"0-0:96.1.4":  {"dsmr_version_be", p1Tag},
+	"0-0:96.1.1":  {"equipment_id", p1HexTag},
+	"1-0:1.8.1":   {"energy_delivered_tariff1", p1Float},
+	"1-0:1.8.2":   {"energy_delivered_tariff2", p1Float},
+	"1-0:2.8.1":   {"energy_returned_tariff1", p1Float},
+	"1-0:2.8.2":   {"energy_returned_tariff2", p1Float},
+	"0-0:96.14.0": {"tariff", p1Integer},
+	"1-0:1.7.0":   {"power_delivered", p1Float},
+	"1-0:2.7.0":   {"power_returned", p1Float},
+	"1-0:21.7.0":  {"power_delivered_l1", p1Float},
+	"1-0:41.7.0":  {"power_delivered_l2", p1Float},
+	"1-0:61.7.0":  {"power_delivered_l3", p1Float},
+	"1-0:22.7.0":  {"power_returned_l1", p1Float},
+	"1-0:42.7.0":  {"power_returned_l2", p1Float},
+	"1-0:62.7.0":  {"power_returned_l3", p1Float},
+	"1-0:32.7.0":  {"voltage_l1", p1Float},
+	"1-0:52.7.0":  {"voltage_l2", p1Float},
+	"1-0:72.7.0":  {"voltage_l3", p1Float},
+	"1-0:31.7.0":  {"current_l1", p1Float},
+	"1-0:51.7.0":  {"current_l2", p1Float},
+	"1-0:71.7.0":  {"current_l3", p1Float},
+	"0-0:96.7.21": {"power_failures", p1Integer},
+	"0-0:96.7.9":  {"long_power_failures", p1Integer},
+	"1-0:32.32.0": {"voltage_sags_l1", p1Integer},
+	"1-0:52.32.0": {"voltage_sags_l2", p1Integer},
+	"1-0:72.32.0": {"voltage_sags_l3", p1Integer},
+	"1-0:32.36.0": {"voltage_swells_l1", p1Integer},
+	"1-0:52.36.0": {"voltage_swells_l2", p1Integer},
+	"1-0:72.36.0": {"voltage_swells_l3", p1Integer},
+	// Belgian eMUCs extensions
+	"1-0:1.4.0":   {"average_demand", p1Float},
+	"1-0:1.6.0":   {"maximum_demand_month", p1StampedFloat},
+	"0-0:96.3.10": {"breaker_state", p1Integer},
+	"0-0:17.0.0":  {"limiter_threshold", p1Float},
+	"1-0:31.4.0":  {"fuse_threshold_l1", p1Float},
+}
+
+// mbusDeviceTypes names the measurement used for each M-Bus device type
+var mbusDeviceTypes = map[int64]string{
+	3:  "gas",
+	4:  "heat",
+	7:  "water",
+	12: "heat",
+}
+
+// mbusReading is the latest reading of a device connected to the meter's M-Bus. The device reports its value
+// periodically (hourly or every 5 minutes) so it carries its own capture time.
+type mbusReading struct {
+	channel     string
+	deviceType  int64
+	equipmentID string
+	captured    time.Time
+	value       float64
+	unit        string
+}
+
+// point converts the reading to a point in a measurement named after the device type
+func (r mbusReading) point() InfluxMessage {
+	measurement, ok := mbusDeviceTypes[r.deviceType]
+	if !ok {
+		measurement = "mbus"
+	}
+	return InfluxMessage{
+		Measurement: measurement,
+		Tags: map[string]string{
+			"equipment_id": r.equipmentID,
+			"channel":      r.channel,
+			"unit":         r.unit,
+		},
+		Fields: map[string]interface{}{
+			"delivered": r.value,
+		},
+		Time: r.captured,
+	}
+}
+
+// p1Line is a single COSEM object from a telegram
+type p1Line struct {
+	obis   string
+	values []string
+}
+
+// p1Telegram is a telegram split into its header and objects
+type p1Telegram struct {
+	header string
+	lines  []p1Line
+}
+
+// isP1Telegram reports whether payload looks like a raw P1 telegram rather than JSON
+func isP1Telegram(payload []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(payload), []byte("/"))
+}
+
+// crc16 computes the CRC-16/ARC checksum used by DSMR (polynomial 0x8005, reflected, initial value 0)
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// parseP1Telegram validates the CRC of a raw telegram and splits it into lines
+func parseP1Telegram(payload []byte) (p1Telegram, error) {
+	start := bytes.IndexByte(payload, '/')
+	end := bytes.LastIndexByte(payload, '!')
+	if start < 0 || end < start {
+		return p1Telegram{}, errors.New("telegram must start with '/' and end with '!'")
+	}
+
+	crcText := string(bytes.TrimSpace(payload[end+1:]))
+	if len(crcText) != 4 {
+		return p1Telegram{}, fmt.Errorf("telegram has no CRC (got %q)", crcText)
+	}
+	expected, err := strconv.ParseUint(crcText, 16, 16)
+	if err != nil {
+		return p1Telegram{}, fmt.Errorf("telegram CRC %q is not hexadecimal", crcText)
+	}
+	if actual := crc16(payload[start : end+1]); uint16(expected) != actual {
+		return p1Telegram{}, fmt.Errorf("telegram CRC mismatch: telegram says %04X, calculated %04X", expected, actual)
+	}
+
+	var telegram p1Telegram
+	for i, raw := range strings.Split(string(payload[start:end]), "\n") {
+		line := strings.TrimSpace(raw)
+		if i == 0 {
+			telegram.header = strings.TrimPrefix(line, "/")
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		open := strings.IndexByte(line, '(')
+		if open <= 0 || !strings.HasSuffix(line, ")") {
+			return p1Telegram{}, fmt.Errorf("malformed telegram line %q", line)
+		}
+		values := strings.Split(strings.TrimSuffix(line[open+1:], ")"), ")(")
+		telegram.lines = append(telegram.lines, p1Line{obis: line[:open], values: values})
+	}
+	return telegram, nil
+}
+
+// parseP1Timestamp parses a YYMMDDhhmmssX timestamp. X is S during daylight saving time (CEST) and W otherwise
+// (CET); DSMR meters always report Dutch/Belgian local time.
+func parseP1Timestamp(s string) (time.Time, error) {
+	if len(s) != 13 {
+		return time.Time{}, fmt.Errorf("invalid telegram timestamp %q", s)
+	}
+	var offset int
+	switch s[12] {
+	case 'S':
+		offset = 2 * 60 * 60
+	case 'W':
+		offset = 1 * 60 * 60
+	default:
+		return time.Time{}, fmt.Errorf("invalid DST flag in telegram timestamp %q", s)
+	}
+	t, err := time.ParseInLocation("060102150405", s[:12], time.FixedZone("", offset))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid telegram timestamp %q: %w", s, err)
+	}
+	return t, nil
+}
+
+// parseP1Number parses a value such as 001234.567*kWh, dropping the unit
+func parseP1Number(s string) (float64, error) {
+	if i := strings.IndexByte(s, '*'); i >= 0 {
+		s = s[:i]
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// buildP1Points decodes a raw P1 telegram into a point with the electricity readings and the readings of any M-Bus
+// devices (gas, water, heat) connected to the meter. The telegram's own timestamp is used for the electricity point
+// (the receive time is used if the telegram has none); M-Bus readings use their capture timestamp. A rule using the
+// receive time applies it to all points.
+func buildP1Points(cfg p1Settings, payload []byte, at timestamps) (InfluxMessage, []mbusReading, error) {
+	telegram, err := parseP1Telegram(payload)
+	if err != nil {
+		return InfluxMessage{}, nil, err
+	}
+
+	point := InfluxMessage{
+		Measurement: cfg.Measurement,
+		Tags:        map[string]string{},
+		Fields:      map[string]interface{}{},
+		Time:        at.received,
+	}
+	if telegram.header != "" {
+		point.Tags["meter"] = telegram.header
+	}
+	channels := make(map[string]*mbusReading)
+	var channelOrder []string
+	for _, line := range telegram.lines {
+		if line.obis == "0-0:1.0.0" {
+			timestamp, err := parseP1Timestamp(line.values[0])
+			if err != nil {
+				return InfluxMessage{}, nil, err
+			}
+			if at.fromPayload() {
+				point.Time = timestamp
+			}
+			continue
+		}
+		if channel, id, ok := mbusObject(line.obis); ok {
+			reading, ok := channels[channel]
+			if !ok {
+				reading = &mbusReading{channel: channel}
+				channels[channel] = reading
+				channelOrder = append(channelOrder, channel)
+			}
+			if err := reading.store(id, line.values); err != nil {
+				return InfluxMessage{}, nil, fmt.Errorf("OBIS %s: %w", line.obis, err)
+			}
+			continue
+		}
+		object, ok := p1Objects[line.obis]
+		if !ok {
+			continue
+		}
+		if err := object.store(point, line.values); err != nil {
+			return InfluxMessage{}, nil, fmt.Errorf("OBIS %s: %w", line.obis, err)
+		}
+	}
+
+	var readings []mbusReading
+	for _, channel := range channelOrder {
+		if reading := channels[channel]; !reading.captured.IsZero() {
+			readings = append(readings, *reading)
+		}
+	}
+	if len(point.Fields) == 0 && len(readings) == 0 {
+		return InfluxMessage{}, nil, errors.New("telegram contains no known readings")
+	}
+	return point, readings, nil
+}
+
+// mbusObject splits an OBIS reference for an M-Bus channel (0-n:... with n from 1 to 4) into the channel number and
+// the object id
+func mbusObject(obis string) (string, string, bool) {
+	if !strings.HasPrefix(obis, "0-") || len(obis) < 5 || obis[3] != ':' || obis[2] < '1' || obis[2] > '4' {
+		return "", "", false
+	}
+	return obis[2:3], obis[4:], true
+}
+
+// store records the value of an M-Bus object
+func (r *mbusReading) store(id string, values []string) error {
+	switch id {
+	case "24.1.0":
+		deviceType, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid device type %q", values[0])
+		}
+		r.deviceType = deviceType
+	case "96.1.0":
+		decoded, err := hex.DecodeString(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid hex value %q", values[0])
+		}
+		r.equipmentID = string(decoded)
+	case "24.2.1", "24.2.3": // Belgian meters report gas as 24.2.3
+		if len(values) != 2 {
+			return fmt.Errorf("expected (timestamp)(value), got %d values", len(values))
+		}
+		captured, err := parseP1Timestamp(values[0])
+		if err != nil {
+			return err
+		}
+		value, err := parseP1Number(values[1])
+		if err != nil {
+			return fmt.Errorf("invalid number %q", values[1])
+		}
+		r.captured, r.value = captured, value
+		if i := strings.IndexByte(values[1], '*'); i >= 0 {
+			r.unit = values[1][i+1:]
+		}
+	}
+	return nil
+}
+
+// store adds the object's value to the point as a field or tag
+func (o p1Object) store(point InfluxMessage, values []string) error {
+	value := values[0]
+	if value == "" {
+		return nil
+	}
+	switch o.kind {
+	case p1Tag:
+		point.Tags[o.name] = value
+	case p1HexTag:
+		decoded, err := hex.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("invalid hex value %q", value)
+		}
+		point.Tags[o.name] = string(decoded)
+	case p1Integer:
+		i, err := strconv.ParseInt(strings.SplitN(value, "*", 2)[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		point.Fields[o.name] = i
+	case p1Float:
+		f, err := parseP1Number(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		point.Fields[o.name] = f
+	case p1StampedFloat:
+		if len(values) != 2 {
+			return fmt.Errorf("expected (timestamp)(value), got %d values", len(values))
+		}
+		f, err := parseP1Number(values[1])
+		if err != nil {
+			return fmt.Errorf("invalid number %q", values[1])
+		}
+		point.Fields[o.name] = f
+	}
+	return nil
+}
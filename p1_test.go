@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// signTelegram joins the lines with CRLF (as sent by the meter) and appends the CRC
+func signTelegram(lines ...string) []byte {
+	body := strings.Join(lines, "\r\n") + "\r\n!"
+	return []byte(fmt.Sprintf("%s%04X\r\n", body, crc16([]byte(body))))
+}
+
+var dsmr5Lines = []string{
+	`/ISk5\2MT382-1000`,
+	``,
+	`1-3:0.2.8(50)`,
+	`0-0:1.0.0(230715134512S)`,
+	`0-0:96.1.1(4B384547303034303436333935353037)`,
+	`1-0:1.8.1(123456.789*kWh)`,
+	`1-0:1.8.2(002345.678*kWh)`,
+	`1-0:2.8.1(000012.345*kWh)`,
+	`1-0:2.8.2(000000.000*kWh)`,
+	`0-0:96.14.0(0002)`,
+	`1-0:1.7.0(01.193*kW)`,
+	`1-0:2.7.0(00.000*kW)`,
+	`0-0:96.7.21(00004)`,
+	`0-0:96.7.9(00002)`,
+	`1-0:99.97.0(2)(0-0:96.7.19)(101208152415W)(0000000240*s)(101208151004W)(0000000301*s)`,
+	`1-0:32.32.0(00002)`,
+	`0-0:96.13.0()`,
+	`1-0:32.7.0(220.1*V)`,
+	`1-0:31.7.0(001*A)`,
+	`1-0:21.7.0(01.111*kW)`,
+	`1-0:22.7.0(00.000*kW)`,
+	`0-1:24.1.0(003)`,
+	`0-1:96.1.0(3232323241424344313233343536373839)`,
+	`0-1:24.2.1(230715134500S)(12785.123*m3)`,
+}
+
+func TestCRC16(t *testing.T) {
+	// Standard check value for CRC-16/ARC
+	if got := crc16([]byte("123456789")); got != 0xBB3D {
+		t.Errorf("crc16 check value = %04X, want BB3D", got)
+	}
+}
+
+func TestBuildP1Point_DSMR5Telegram(t *testing.T) {
+	received := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	point, readings, err := buildP1Points(defaultSettings(config{}).P1, signTelegram(dsmr5Lines...), receivedAt(received))
+	if err != nil {
+		t.Fatalf("buildP1Points returned error: %v", err)
+	}
+
+	if point.Measurement != "p1" {
+		t.Errorf("expected measurement p1, got %q", point.Measurement)
+	}
+	expectedTime := time.Date(2023, 7, 15, 11, 45, 12, 0, time.UTC)
+	if !point.Time.Equal(expectedTime) {
+		t.Errorf("expected summer time telegram timestamp %v, got %v", expectedTime, point.Time.UTC())
+	}
+	if point.Tags["equipment_id"] != "K8EG004046395507" {
+		t.Errorf("expected decoded equipment_id, got %q", point.Tags["equipment_id"])
+	}
+	if point.Tags["dsmr_version"] != "50" {
+		t.Errorf("expected dsmr_version 50, got %q", point.Tags["dsmr_version"])
+	}
+
+	expectedFields := map[string]interface{}{
+		"energy_delivered_tariff1": 123456.789,
+		"energy_delivered_tariff2": 2345.678,
+		"energy_returned_tariff1":  12.345,
+		"energy_returned_tariff2":  float64(0),
+		"tariff":                   int64(2),
+		"power_delivered":          1.193,
+		"power_returned":           float64(0),
+		"power_failures":           int64(4),
+		"long_power_failures":      int64(2),
+		"voltage_sags_l1":          int64(2),
+		"voltage_l1":               220.1,
+		"current_l1":               float64(1),
+		"power_delivered_l1":       1.111,
+		"power_returned_l1":        float64(0),
+	}
+	for key, expected := range expectedFields {
+		if got := point.Fields[key]; got != expected {
+			t.Errorf("field %s = %#v, want %#v", key, got, expected)
+		}
+	}
+	if len(point.Fields) != len(expectedFields) {
+		t.Errorf("expected %d fields, got %d: %v", len(expectedFields), len(point.Fields), point.Fields)
+	}
+
+	if len(readings) != 1 {
+		t.Fatalf("expected 1 M-Bus reading, got %d", len(readings))
+	}
+	gas := readings[0].point()
+	if gas.Measurement != "gas" || gas.Tags["equipment_id"] != "2222ABCD123456789" || gas.Tags["channel"] != "1" {
+		t.Errorf("unexpected gas measurement or tags: %q %v", gas.Measurement, gas.Tags)
+	}
+	if gas.Fields["delivered"] != 12785.123 || gas.Tags["unit"] != "m3" {
+		t.Errorf("expected 12785.123 m3 delivered, got %v %v", gas.Fields, gas.Tags)
+	}
+	if !gas.Time.Equal(time.Date(2023, 7, 15, 11, 45, 0, 0, time.UTC)) {
+		t.Errorf("expected gas reading at its capture time, got %v", gas.Time.UTC())
+	}
+}
+
+func TestBuildP1Point_BelgianTelegram(t *testing.T) {
+	telegram := signTelegram(
+		`/FLU5\253769484_A`,
+		``,
+		`0-0:96.1.4(50217)`,
+		`0-0:1.0.0(231218093000W)`,
+		`1-0:1.8.1(001234.567*kWh)`,
+		`1-0:1.4.0(02.351*kW)`,
+		`1-0:1.6.0(231201184500W)(04.567*kW)`,
+		`0-0:96.3.10(1)`,
+	)
+
+	point, _, err := buildP1Points(defaultSettings(config{}).P1, telegram, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildP1Points returned error: %v", err)
+	}
+	if !point.Time.Equal(time.Date(2023, 12, 18, 8, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected winter time telegram timestamp, got %v", point.Time.UTC())
+	}
+	if point.Fields["maximum_demand_month"] != 4.567 || point.Fields["average_demand"] != 2.351 {
+		t.Errorf("unexpected demand fields: %v", point.Fields)
+	}
+	if point.Fields["breaker_state"] != int64(1) || point.Tags["dsmr_version_be"] != "50217" {
+		t.Errorf("unexpected breaker state or version: %v %v", point.Fields, point.Tags)
+	}
+}
+
+func TestBuildP1Point_RejectsInvalidTelegrams(t *testing.T) {
+	valid := signTelegram(dsmr5Lines...)
+	tampered := []byte(strings.Replace(string(valid), "01.193*kW", "91.193*kW", 1))
+	unsigned := []byte(strings.Join(dsmr5Lines, "\r\n") + "\r\n!\r\n")
+	badTimestamp := signTelegram(`/ISk5\2MT382-1000`, `0-0:1.0.0(230715134512X)`, `1-0:1.7.0(01.193*kW)`)
+	noReadings := signTelegram(`/ISk5\2MT382-1000`, `0-0:1.0.0(230715134512S)`)
+
+	for name, payload := range map[string][]byte{
+		"tampered":      tampered,
+		"missing crc":   unsigned,
+		"bad timestamp": badTimestamp,
+		"no readings":   noReadings,
+		"no end marker": []byte(`/ISk5\2MT382-1000`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := buildP1Points(defaultSettings(config{}).P1, payload, receivedAt(time.Now())); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestHandle_P1TelegramWrittenToTopicBucket(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+
+	// The second telegram repeats the same gas reading, which must not be written again
+	h.handle(&paho.Publish{Topic: "p1/home", Payload: signTelegram(dsmr5Lines...)})
+	h.handle(&paho.Publish{Topic: "p1/home", Payload: signTelegram(dsmr5Lines...)})
+	h.handle(&paho.Publish{Topic: "p1/home", Payload: []byte("/ISk5\\2MT382-1000\r\n!0000")})
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if _, ok := h.writeAPIs["home"]; !ok || report.flushed != 3 {
+		t.Errorf("expected two electricity and one gas point in the home bucket, got %s for buckets %v", report, h.writeAPIs)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a rate limit does with the messages (or points) over the limit
+const (
+	limitDrop   = "drop"   // drop them
+	limitSample = "sample" // keep one in every sample_every of them
+	limitLatest = "latest" // hold the latest one and handle it once the limit allows
+)
+
+// limitModes lists the values of a rate limit's mode
+var limitModes = []string{limitDrop, limitSample, limitLatest}
+
+// What a rate limit keeps a token bucket for
+const (
+	limitPerFilter = "filter" // all messages on topics matching the limit's filter
+	limitPerTopic  = "topic"  // the messages on each topic
+	limitPerSeries = "series" // the points of each series (bucket, measurement and tags), after the rule is applied
+)
+
+// limitScopes lists the values of a rate limit's per
+var limitScopes = []string{limitPerFilter, limitPerTopic, limitPerSeries}
+
+// defaultSampleEvery is the sample_every of rate limits that do not set it
+const defaultSampleEvery = 10
+
+// rateLimit limits the messages on the topics matching a filter, or the points of their series, with a token bucket
+// that holds burst tokens and is refilled at rate tokens per second
+type rateLimit struct {
+	Topic       string  `json:"topic"`        // MQTT topic filter (may include + and # wildcards)
+	Rate        float64 `json:"rate"`         // messages (or points) per second
+	Burst       int     `json:"burst"`        // messages (or points) let through at once (default the rate rounded up)
+	Per         string  `json:"per"`          // filter (default), topic or series
+	Mode        string  `json:"mode"`         // drop (default), sample or latest
+	SampleEvery int     `json:"sample_every"` // in sample mode, one in this many limited messages is kept (default 10)
+}
+
+// validate checks a rate limit
+func (l *rateLimit) validate() error {
+	var errs []error
+	if err := validateTopicFilter(l.Topic); err != nil {
+		errs = append(errs, err)
+	}
+	if l.Rate <= 0 {
+		errs = append(errs, errors.New("rate: must be positive"))
+	}
+	if l.Burst < 0 {
+		errs = append(errs, errors.New("burst: must not be negative"))
+	}
+	if l.Per != "" && !containsString(limitScopes, l.Per) {
+		errs = append(errs, fmt.Errorf("per: must be one of %s, got %q", strings.Join(limitScopes, ", "), l.Per))
+	}
+	if l.Mode != "" && !containsString(limitModes, l.Mode) {
+		errs = append(errs, fmt.Errorf("mode: must be one of %s, got %q", strings.Join(limitModes, ", "), l.Mode))
+	}
+	if l.SampleEvery < 0 {
+		errs = append(errs, errors.New("sample_every: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// per returns what the limit keeps a token bucket for
+func (l *rateLimit) per() string {
+	if l.Per == "" {
+		return limitPerFilter
+	}
+	return l.Per
+}
+
+// mode returns what the limit does with the messages over the limit
+func (l *rateLimit) mode() string {
+	if l.Mode == "" {
+		return limitDrop
+	}
+	return l.Mode
+}
+
+// burst returns the number of tokens the limit's buckets hold
+func (l *rateLimit) burst() float64 {
+	if l.Burst == 0 {
+		return math.Max(1, math.Ceil(l.Rate))
+	}
+	return float64(l.Burst)
+}
+
+// sampleEvery returns one in how many limited messages sample mode keeps
+func (l *rateLimit) sampleEvery() uint64 {
+	if l.SampleEvery == 0 {
+		return defaultSampleEvery
+	}
+	return uint64(l.SampleEvery)
+}
+
+// key returns the token bucket of the limit that a message on topic (or a point of series) is counted against
+func (l *rateLimit) key(topic, series string) string {
+	switch l.per() {
+	case limitPerTopic:
+		return l.Topic + "\x00" + l.per() + "\x00" + topic
+	case limitPerSeries:
+		return l.Topic + "\x00" + l.per() + "\x00" + series
+	}
+	return l.Topic + "\x00" + l.per()
+}
+
+// rateLimitFor returns the first rate limit whose topic filter matches topic and that limits series (or messages,
+// if series is false), or nil if there is none
+func (s *settings) rateLimitFor(topic string, series bool) *rateLimit {
+	for i := range s.RateLimits {
+		l := &s.RateLimits[i]
+		if (l.per() == limitPerSeries) == series && matchTopic(l.Topic, topic) {
+			return l
+		}
+	}
+	return nil
+}
+
+// tokenBucket is the state of one token bucket of a rate limit
+type tokenBucket struct {
+	limit   string // topic filter of the limit, which its count is kept by
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+	sampled uint64 // messages limited in sample mode
+	held    func() // handles the latest limited message in latest mode (nil if there is none)
+}
+
+// refill adds the tokens accrued up to now
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// rateLimiter keeps the token buckets of the rate limits and counts the messages and points they limit. The zero
+// value is ready to use.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	limited map[string]uint64 // messages and points dropped, by the topic filter of the limit
+}
+
+// allow takes a token from the bucket key of limit l and reports whether the message (or point) may be handled.
+// Over the limit, sample mode lets one in every sample_every through and latest mode holds on to handle, replacing
+// the message held before; release calls it once a token is available.
+func (r *rateLimiter) allow(l *rateLimit, key string, now time.Time, handle func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		r.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst(), updated: now}
+		r.buckets[key] = b
+	}
+	// A reload may have changed the limit
+	b.limit, b.rate, b.burst = l.Topic, l.Rate, l.burst()
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		if b.held != nil {
+			// Superseded by a newer message
+			b.held = nil
+			r.count(b.limit)
+		}
+		return true
+	}
+	switch l.mode() {
+	case limitSample:
+		b.sampled++
+		if b.sampled%l.sampleEvery() == 0 {
+			return true
+		}
+	case limitLatest:
+		if b.held != nil {
+			r.count(b.limit)
+		}
+		b.held = handle
+		return false
+	}
+	r.count(b.limit)
+	return false
+}
+
+// count records a message dropped by the limit with topic filter limit (guarded by mu)
+func (r *rateLimiter) count(limit string) {
+	if r.limited == nil {
+		r.limited = make(map[string]uint64)
+	}
+	r.limited[limit]++
+}
+
+// release returns the held messages whose bucket has a token available at now, taking the token (all held messages
+// if now is zero), and forgets the buckets that are full and hold nothing
+func (r *rateLimiter) release(now time.Time) []func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var released []func()
+	for key, b := range r.buckets {
+		if !now.IsZero() {
+			b.refill(now)
+		}
+		if b.held != nil && (now.IsZero() || b.tokens >= 1) {
+			if !now.IsZero() {
+				b.tokens--
+			}
+			released = append(released, b.held)
+			b.held = nil
+		}
+		if b.held == nil && b.tokens >= b.burst {
+			delete(r.buckets, key)
+		}
+	}
+	return released
+}
+
+// counts returns the number of messages and points dropped so far, by the topic filter of the limit
+func (r *rateLimiter) counts() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]uint64, len(r.limited))
+	for limit, n := range r.limited {
+		counts[limit] = n
+	}
+	return counts
+}
+
+// formatLimited describes the counts returned by rateLimiter.counts, e.g. "1200 (sensors/#: 1200)"
+func formatLimited(counts map[string]uint64) string {
+	var total uint64
+	limits := make([]string, 0, len(counts))
+	for limit, n := range counts {
+		total += n
+		limits = append(limits, fmt.Sprintf("%s: %d", limit, n))
+	}
+	if total == 0 {
+		return "0"
+	}
+	sort.Strings(limits)
+	return fmt.Sprintf("%d (%s)", total, strings.Join(limits, ", "))
+}
+
+// limitedSince returns the counts that increased from reported to counts, by how much (nil if none did)
+func limitedSince(counts, reported map[string]uint64) map[string]uint64 {
+	var increased map[string]uint64
+	for limit, n := range counts {
+		if n > reported[limit] {
+			if increased == nil {
+				increased = make(map[string]uint64)
+			}
+			increased[limit] = n - reported[limit]
+		}
+	}
+	return increased
+}
+
+// limitedLogInterval is how often the messages and points limited since the last log are logged while running
+const limitedLogInterval = time.Minute
+
+// releaseLimited periodically handles the messages held by rate limits in latest mode, and logs the messages and
+// points limited, until ctx is done
+func releaseLimited(ctx context.Context, h *handler) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	logTicker := time.NewTicker(limitedLogInterval)
+	defer logTicker.Stop()
+	var reported map[string]uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-logTicker.C:
+			counts := h.limiter.counts()
+			if increased := limitedSince(counts, reported); increased != nil {
+				fmt.Printf("Messages and points limited in the last %s: %s\n", limitedLogInterval, formatLimited(increased))
+			}
+			reported = counts
+		case now := <-ticker.C:
+			// Once Shutdown has started it handles the held messages itself
+			if !h.acquire() {
+				return
+			}
+			for _, handle := range h.limiter.release(now) {
+				handle()
+			}
+			h.inflight.Done()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    rateLimit
+		expected []bool
+		limited  uint64 // before release
+		held     bool
+	}{
+		{"drop", rateLimit{Topic: "sensors/#", Rate: 1, Burst: 2}, []bool{true, true, false, false, false, false}, 4, false},
+		{"sample", rateLimit{Topic: "sensors/#", Rate: 1, Burst: 2, Mode: limitSample, SampleEvery: 2}, []bool{true, true, false, true, false, true}, 2, false},
+		{"latest", rateLimit{Topic: "sensors/#", Rate: 1, Burst: 2, Mode: limitLatest}, []bool{true, true, false, false, false, false}, 3, true},
+		{"default burst", rateLimit{Topic: "sensors/#", Rate: 0.5}, []bool{true, false, false, false, false, false}, 5, false},
+	}
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r rateLimiter
+			var handled []int
+			got := make([]bool, len(tt.expected))
+			for i := range tt.expected {
+				got[i] = r.allow(&tt.limit, tt.limit.key("sensors/t/l/1", ""), start, func() { handled = append(handled, i) })
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+			if limited := r.counts()["sensors/#"]; limited != tt.limited {
+				t.Errorf("expected %d limited, got %d", tt.limited, limited)
+			}
+
+			if released := r.release(start); len(released) != 0 {
+				t.Errorf("expected nothing released without a token, got %d", len(released))
+			}
+			for _, handle := range r.release(start.Add(time.Second)) {
+				handle()
+			}
+			if tt.held && !reflect.DeepEqual(handled, []int{len(tt.expected) - 1}) {
+				t.Errorf("expected the latest message to be handled once a token is available, got %v", handled)
+			}
+			if !tt.held && len(handled) != 0 {
+				t.Errorf("expected no message to be held, got %v", handled)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Refill(t *testing.T) {
+	var r rateLimiter
+	limit := rateLimit{Topic: "sensors/#", Rate: 2, Burst: 1}
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, tt := range []struct {
+		offset   time.Duration
+		expected bool
+	}{
+		{0, true},
+		{200 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{10 * time.Second, true}, // no more than burst tokens accrue
+		{10 * time.Second, false},
+	} {
+		if got := r.allow(&limit, limit.key("", ""), start.Add(tt.offset), nil); got != tt.expected {
+			t.Errorf("message %d at +%s: expected %v, got %v", i, tt.offset, tt.expected, got)
+		}
+	}
+}
+
+func TestHandle_RateLimits(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.RateLimits = []rateLimit{
+		{Topic: "sensors/#", Rate: 0.001, Burst: 2, Per: limitPerTopic},
+		{Topic: "victron/#", Rate: 0.001, Burst: 1, Per: limitPerSeries, Mode: limitLatest},
+	}
+	h.swapSettings(s)
+
+	for i := 0; i < 5; i++ {
+		h.handle(testPublish("sensors/temperature/garden/t1", fmt.Sprintf(`{"value": %d}`, 20+i), false, false))
+	}
+	h.handle(testPublish("sensors/temperature/garden/t2", `{"value": 19}`, false, false))
+	for i := 0; i < 3; i++ {
+		h.handle(testPublish("victron/a7f3c19de82b/grid/40/Ac/L3/Power", fmt.Sprintf(`{"value": %d}`, -1393-i), false, false))
+	}
+	h.handle(testPublish("victron/a7f3c19de82b/grid/41/Ac/L3/Power", `{"value": 12}`, false, false))
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	// Two of t1, t2, the first and the latest (held) point of device 40 and the point of device 41
+	if report.flushed != 6 {
+		t.Errorf("expected 6 points flushed, got %s", report)
+	}
+	expected := map[string]uint64{"sensors/#": 3, "victron/#": 1}
+	if !reflect.DeepEqual(report.limited, expected) {
+		t.Errorf("expected limited %v, got %v", expected, report.limited)
+	}
+}
+
+func TestShutdown_WritesMessagesHeldTwice(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.RateLimits = []rateLimit{
+		{Topic: "victron/#", Rate: 0.001, Burst: 1, Mode: limitLatest},
+		{Topic: "victron/#", Rate: 0.001, Burst: 1, Per: limitPerSeries, Mode: limitLatest},
+	}
+	h.swapSettings(s)
+
+	// The second message is held by the message limit and, once released on shutdown, by the series limit
+	h.handle(testPublish("victron/a7f3c19de82b/grid/40/Ac/L3/Power", `{"value": -1393}`, false, false))
+	h.handle(testPublish("victron/a7f3c19de82b/grid/40/Ac/L3/Power", `{"value": -1394}`, false, false))
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 2 {
+		t.Errorf("expected 2 points flushed, got %s", report)
+	}
+}
+
+func TestFormatLimited(t *testing.T) {
+	if got := formatLimited(nil); got != "0" {
+		t.Errorf("expected 0, got %q", got)
+	}
+	if got := formatLimited(map[string]uint64{"victron/#": 1, "sensors/#": 1200}); got != "1201 (sensors/#: 1200, victron/#: 1)" {
+		t.Errorf("unexpected description %q", got)
+	}
+}
+
+func TestLimitedSince(t *testing.T) {
+	reported := map[string]uint64{"sensors/#": 1200, "victron/#": 1}
+	if got := limitedSince(reported, reported); got != nil {
+		t.Errorf("expected nothing limited, got %v", got)
+	}
+	counts := map[string]uint64{"sensors/#": 1250, "victron/#": 1, "p1/#": 3}
+	expected := map[string]uint64{"sensors/#": 50, "p1/#": 3}
+	if got := limitedSince(counts, reported); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got := limitedSince(counts, nil); !reflect.DeepEqual(got, counts) {
+		t.Errorf("expected %v, got %v", counts, got)
+	}
+}
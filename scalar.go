@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// scalarTopic maps bare values (such as 21.5 or ON) published on matching topics to points. Bucket, measurement,
+// field and tag values are templates in which {n} is replaced by the n-th level of the topic (counting from 1).
+type scalarTopic struct {
+	Topic       string            `json:"topic"`       // MQTT topic filter (may include + and # wildcards)
+	Bucket      string            `json:"bucket"`      // bucket template
+	Measurement string            `json:"measurement"` // measurement template
+	Field       string            `json:"field"`       // field name template ("value" if blank)
+	Tags        map[string]string `json:"tags"`        // tag name → value template
+}
+
+// scalarFor returns the first scalar topic whose filter matches topic (or nil if there is none)
+func (s *settings) scalarFor(topic string) *scalarTopic {
+	for i := range s.Scalars {
+		if matchTopic(s.Scalars[i].Topic, topic) {
+			return &s.Scalars[i]
+		}
+	}
+	return nil
+}
+
+// validate checks the filter and that the templates only refer to topic levels the filter can match
+func (t scalarTopic) validate() error {
+	if err := validateTopicFilter(t.Topic); err != nil {
+		return err
+	}
+	if t.Bucket == "" || t.Measurement == "" {
+		return errors.New("bucket and measurement are required")
+	}
+	templates := map[string]string{"bucket": t.Bucket, "measurement": t.Measurement, "field": t.Field}
+	for name, tmpl := range t.Tags {
+		if name == "" {
+			return errors.New("empty tag name")
+		}
+		templates["tag "+name] = tmpl
+	}
+	return validateTemplates(t.Topic, templates)
+}
+
+// validateTemplates checks that each template is well formed and only refers to topic levels the filter can match
+func validateTemplates(filter string, templates map[string]string) error {
+	levels := strings.Split(filter, "/")
+	maxLevel := len(levels)
+	if levels[len(levels)-1] == "#" {
+		maxLevel = -1
+	}
+	for name, tmpl := range templates {
+		refs, err := templateLevels(tmpl)
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", name, tmpl, err)
+		}
+		for _, n := range refs {
+			if maxLevel >= 0 && n > maxLevel {
+				return fmt.Errorf("%s %q: the topic filter has only %d levels", name, tmpl, maxLevel)
+			}
+		}
+	}
+	return nil
+}
+
+// templateLevels returns the topic levels referred to by a template
+func templateLevels(tmpl string) ([]int, error) {
+	var refs []int
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			if strings.IndexByte(tmpl, '}') >= 0 {
+				return nil, errors.New("unmatched }")
+			}
+			return refs, nil
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return nil, errors.New("unmatched {")
+		}
+		n, err := strconv.Atoi(tmpl[start+1 : start+end])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid topic level %q", tmpl[start+1:start+end])
+		}
+		refs = append(refs, n)
+		tmpl = tmpl[start+end+1:]
+	}
+}
+
+// expandTemplate replaces each {n} in tmpl by the n-th of levels
+func expandTemplate(tmpl string, levels []string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			b.WriteString(tmpl)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return "", errors.New("unmatched {")
+		}
+		n, err := strconv.Atoi(tmpl[start+1 : start+end])
+		if err != nil || n < 1 || n > len(levels) {
+			return "", fmt.Errorf("topic has no level %s", tmpl[start+1:start+end])
+		}
+		b.WriteString(tmpl[:start])
+		b.WriteString(levels[n-1])
+		tmpl = tmpl[start+end+1:]
+	}
+}
+
+// parseScalar converts a bare payload to the value it is written as: ON/OFF and true/false (in any case) become
+// booleans, numbers become integers or floats, and anything else is a string. ok is false for empty payloads and
+// JSON objects or arrays.
+func parseScalar(cfg valueSettings, payload []byte) (interface{}, bool) {
+	text := string(bytes.TrimSpace(payload))
+	if text == "" || text[0] == '{' || text[0] == '[' {
+		return nil, false
+	}
+	switch strings.ToLower(text) {
+	case "on", "true":
+		return true, true
+	case "off", "false":
+		return false, true
+	}
+	if cfg.Integers != nil && *cfg.Integers {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return i, true
+		}
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, true
+	}
+	return text, true
+}
+
+// buildScalarPoint turns a bare value into a point described by the scalar topic's templates
+func buildScalarPoint(t *scalarTopic, values valueSettings, topic string, payload []byte, at timestamps) (string, InfluxMessage, error) {
+	val, ok := parseScalar(values, payload)
+	if !ok {
+		return "", InfluxMessage{}, errors.New("payload is not a scalar value")
+	}
+
+	levels := strings.Split(topic, "/")
+	field := t.Field
+	if field == "" {
+		field = "value"
+	}
+	expanded := make(map[string]string, 3)
+	for name, tmpl := range map[string]string{"bucket": t.Bucket, "measurement": t.Measurement, "field": field} {
+		value, err := expandTemplate(tmpl, levels)
+		if err != nil {
+			return "", InfluxMessage{}, fmt.Errorf("%s: %w", name, err)
+		}
+		expanded[name] = value
+	}
+	tags := make(map[string]string, len(t.Tags))
+	for name, tmpl := range t.Tags {
+		value, err := expandTemplate(tmpl, levels)
+		if err != nil {
+			return "", InfluxMessage{}, fmt.Errorf("tag %s: %w", name, err)
+		}
+		tags[name] = value
+	}
+
+	fields := make(map[string]interface{}, 1)
+	if text, isString := val.(string); isString {
+		switch values.Strings {
+		case "field":
+			fields[expanded["field"]] = text
+		case "tag":
+			tags[expanded["field"]] = text
+		}
+	} else {
+		fields[expanded["field"]] = val
+	}
+
+	return expanded["bucket"], InfluxMessage{
+		Measurement: expanded["measurement"],
+		Tags:        tags,
+		Fields:      fields,
+		Time:        at.received,
+	}, nil
+}
+
+// handleScalarMessage writes a bare value published on a topic configured in scalars
+func (o *handler) handleScalarMessage(s *settings, msg *paho.Publish, at timestamps) {
+	bucket, point, err := buildScalarPoint(s.scalarFor(msg.Topic), s.Values, msg.Topic, msg.Payload, at)
+	if err != nil {
+		fmt.Printf("Scalar message could not be parsed (%s): %s\n", msg.Topic, err)
+		return
+	}
+	if len(point.Fields) == 0 {
+		return
+	}
+	o.emit(s, msg, bucket, point)
+}
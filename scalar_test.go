@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestParseScalar(t *testing.T) {
+	cfg := defaultSettings(config{}).Values
+	tests := []struct {
+		payload  string
+		expected interface{}
+	}{
+		{"21.5", 21.5},
+		{" 42\n", int64(42)},
+		{"-3e2", -300.0},
+		{"ON", true},
+		{"off", false},
+		{"True", true},
+		{"false", false},
+		{"heat", "heat"},
+	}
+	for _, tt := range tests {
+		got, ok := parseScalar(cfg, []byte(tt.payload))
+		if !ok || got != tt.expected {
+			t.Errorf("parseScalar(%q) = %v (%T), want %v (%T)", tt.payload, got, got, tt.expected, tt.expected)
+		}
+	}
+	for _, payload := range []string{"", "  ", `{"value": 1}`, "[1, 2]"} {
+		if _, ok := parseScalar(cfg, []byte(payload)); ok {
+			t.Errorf("expected %q not to be a scalar", payload)
+		}
+	}
+}
+
+func TestBuildScalarPoint(t *testing.T) {
+	scalar := &scalarTopic{
+		Topic:       "home/+/+",
+		Bucket:      "home",
+		Measurement: "{3}",
+		Tags:        map[string]string{"room": "{2}", "source": "mqtt-{1}"},
+	}
+	received := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	bucket, point, err := buildScalarPoint(scalar, defaultSettings(config{}).Values, "home/livingroom/temperature", []byte("21.5"), receivedAt(received))
+	if err != nil {
+		t.Fatalf("buildScalarPoint returned error: %v", err)
+	}
+	if bucket != "home" || point.Measurement != "temperature" || !point.Time.Equal(received) {
+		t.Errorf("unexpected bucket, measurement or time: %q %q %v", bucket, point.Measurement, point.Time)
+	}
+	if point.Tags["room"] != "livingroom" || point.Tags["source"] != "mqtt-home" {
+		t.Errorf("unexpected tags: %v", point.Tags)
+	}
+	if point.Fields["value"] != 21.5 {
+		t.Errorf("expected value=21.5, got %v", point.Fields)
+	}
+}
+
+func TestScalarTopicValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		scalar scalarTopic
+		valid  bool
+	}{
+		{"valid", scalarTopic{Topic: "home/+/+", Bucket: "home", Measurement: "{3}", Field: "{2}"}, true},
+		{"multi-level wildcard", scalarTopic{Topic: "home/#", Bucket: "home", Measurement: "{5}"}, true},
+		{"level beyond filter", scalarTopic{Topic: "home/+/+", Bucket: "home", Measurement: "{4}"}, false},
+		{"level zero", scalarTopic{Topic: "home/+/+", Bucket: "home", Measurement: "{0}"}, false},
+		{"unmatched brace", scalarTopic{Topic: "home/+/+", Bucket: "home", Measurement: "{3"}, false},
+		{"no bucket", scalarTopic{Topic: "home/+/+", Measurement: "{3}"}, false},
+		{"invalid tag template", scalarTopic{Topic: "home/+/+", Bucket: "home", Measurement: "m", Tags: map[string]string{"room": "{x}"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.scalar.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid=%v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestHandle_ScalarTopicsTakePrecedence(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.Scalars = []scalarTopic{{Topic: "home/+/+", Bucket: "home", Measurement: "{3}", Tags: map[string]string{"room": "{2}"}}}
+	h.swapSettings(s)
+
+	h.handle(&paho.Publish{Topic: "home/p1-hallway/motion", Payload: []byte("ON")})
+	h.handle(&paho.Publish{Topic: "home/livingroom/temperature", Payload: []byte(`{"value": 21.5}`)})
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 1 {
+		t.Errorf("expected only the scalar value to be written, got %d points", report.flushed)
+	}
+	if _, ok := h.writeAPIs["home"]; !ok {
+		t.Errorf("expected point in the home bucket, got buckets %v", h.writeAPIs)
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Settings that can be changed at runtime are read from a JSON file (named by the RULESFILE environmental variable)
+// and re-read whenever the process receives SIGHUP. Anything not present in the file keeps its default value.
+
+// settings holds the reloadable configuration used by the handler
+type settings struct {
+	Topics       []string            `json:"topics"`        // topic filters to subscribe to
+	Solar        solarSettings       `json:"solar"`         // SolarEdge decoder options
+	Victron      victronSettings     `json:"victron"`       // Victron decoder options
+	P1           p1Settings          `json:"p1"`            // DSMR P1 telegram decoder options
+	Zigbee2MQTT  zigbeeSettings      `json:"zigbee2mqtt"`   // Zigbee2MQTT decoder options
+	Tasmota      tasmotaSettings     `json:"tasmota"`       // Tasmota telemetry decoder options
+	Shelly       shellySettings      `json:"shelly"`        // Shelly Gen2 notification decoder options
+	Sparkplug    sparkplugSettings   `json:"sparkplug"`     // Sparkplug B decoder options
+	Values       valueSettings       `json:"values"`        // how decoders type numbers and store strings
+	Scalars      []scalarTopic       `json:"scalars"`       // topics with bare values, decoded using topic templates
+	LineProtocol []lineProtocolTopic `json:"line_protocol"` // topics whose payload is InfluxDB line protocol
+	Rules        []rule              `json:"rules"`         // mapping rules applied to decoded points (first match wins)
+	Precision    precisionSettings   `json:"precision"`     // precision points are written with, per bucket
+	Dedup        dedupSettings       `json:"dedup"`         // suppression of messages the broker delivers again
+	RateLimits   []rateLimit         `json:"rate_limits"`   // limits on the messages per topic filter or points per series
+
+	// MQTT v5 properties
+	ContentTypes     map[string]string `json:"content_types"`      // content type → payload format, on top of the defaults
+	UserPropertyTags []string          `json:"user_property_tags"` // user properties copied onto every point as tags
+}
+
+// solarSettings holds the options for the SolarEdge decoder
+type solarSettings struct {
+	TagKeys       []string         `json:"tag_keys"`       // data fields stored as tags instead of fields
+	Fields        []solarFieldRule `json:"fields"`         // bucket for each data field (first match wins)
+	UnknownBucket string           `json:"unknown_bucket"` // bucket for fields no rule matches (skipped if blank)
+	Conversions   []conversion     `json:"conversions"`    // unit conversions applied to data fields
+
+	// NotImplemented lists the SunSpec "not implemented" sentinels; raw values (and scale factors) equal to one of
+	// these are treated as missing
+	NotImplemented []float64 `json:"not_implemented"`
+
+	tagKeys map[string]bool
+}
+
+// solarFieldRule routes SolarEdge data fields whose key has the given prefix and/or suffix to a bucket
+type solarFieldRule struct {
+	Prefix string `json:"prefix"`
+	Suffix string `json:"suffix"`
+	Bucket string `json:"bucket"`
+}
+
+// matches reports whether key has both the rule's prefix and suffix (a blank prefix or suffix matches anything)
+func (r solarFieldRule) matches(key string) bool {
+	return strings.HasPrefix(key, r.Prefix) && strings.HasSuffix(key, r.Suffix)
+}
+
+// isNotImplemented reports whether val is one of the SunSpec "not implemented" sentinels
+func (s solarSettings) isNotImplemented(val float64) bool {
+	for _, sentinel := range s.NotImplemented {
+		if val == sentinel {
+			return true
+		}
+	}
+	return false
+}
+
+// victronSettings holds the options for the Victron decoder
+type victronSettings struct {
+	SkipSuffixes []string `json:"skip_suffixes"` // topics ending in one of these are ignored
+
+	// Venus OS only publishes on N/ topics while it receives keepalive requests. Requests are sent to the listed
+	// portals and to any portal seen on an N/ topic; an interval of 0 disables them.
+	KeepaliveInterval *duration `json:"keepalive_interval"`
+	Portals           []string  `json:"portals"`
+}
+
+// p1Settings holds the options for the DSMR P1 telegram decoder
+type p1Settings struct {
+	Measurement string `json:"measurement"` // measurement the electricity readings are written to
+}
+
+// zigbeeSettings holds the options for the Zigbee2MQTT decoder
+type zigbeeSettings struct {
+	BaseTopic   string   `json:"base_topic"`  // Zigbee2MQTT's base topic; devices publish on <base topic>/<friendly name>
+	Bucket      string   `json:"bucket"`      // bucket device states are written to
+	Measurement string   `json:"measurement"` // measurement device states are written to
+	Exclude     []string `json:"exclude"`     // state members that are not stored
+	DeviceTags  *bool    `json:"device_tags"` // tag points with model and vendor from <base topic>/bridge/devices
+}
+
+// tasmotaSettings holds the options for the Tasmota telemetry decoder
+type tasmotaSettings struct {
+	Bucket      string `json:"bucket"`      // bucket sensor readings are written to
+	Measurement string `json:"measurement"` // measurement sensor readings are written to
+	TimeZone    string `json:"time_zone"`   // IANA time zone of the devices' clocks ("Local" for the bridge's own)
+
+	location *time.Location
+}
+
+// shellySettings holds the options for the Shelly Gen2 notification decoder
+type shellySettings struct {
+	Bucket      string   `json:"bucket"`      // bucket component status is written to
+	Measurement string   `json:"measurement"` // measurement component status is written to
+	Exclude     []string `json:"exclude"`     // component members that are not stored (at any depth)
+}
+
+// sparkplugSettings holds the options for the Sparkplug B decoder
+type sparkplugSettings struct {
+	Bucket      string   `json:"bucket"`      // bucket metrics and online status are written to
+	Measurement string   `json:"measurement"` // measurement metrics and online status are written to
+	Exclude     []string `json:"exclude"`     // metrics whose name starts with one of these are not stored
+}
+
+// excluded reports whether the metric is not stored
+func (s sparkplugSettings) excluded(name string) bool {
+	for _, prefix := range s.Exclude {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// precisionSettings holds the precision points are written with. Point times are truncated to the precision of their
+// bucket, so that a point written again (e.g. from a redelivered message) replaces the earlier one.
+type precisionSettings struct {
+	Default string            `json:"default"` // precision of buckets not listed: "s", "ms", "us" or "ns"
+	Buckets map[string]string `json:"buckets"` // bucket → precision
+}
+
+// forBucket returns the write precision of bucket
+func (p precisionSettings) forBucket(bucket string) time.Duration {
+	if precision, ok := epochUnits[p.Buckets[bucket]]; ok {
+		return precision
+	}
+	if precision, ok := epochUnits[p.Default]; ok {
+		return precision
+	}
+	return time.Nanosecond
+}
+
+// dedupSettings holds the options for suppressing messages the broker delivers again
+type dedupSettings struct {
+	Enabled     *bool     `json:"enabled"`      // skip messages whose topic and payload were seen within ttl
+	FlaggedOnly *bool     `json:"flagged_only"` // only skip messages the broker flags as redelivered (DUP)
+	Size        int       `json:"size"`         // number of messages (and topics) remembered
+	TTL         *duration `json:"ttl"`          // how long a message is remembered
+	Persist     *bool     `json:"persist"`      // save what is remembered in SESSIONFOLDER on shutdown (if it is used)
+	Retained    string    `json:"retained"`     // retained messages: "process", "skip" or "changed"
+}
+
+// rule changes where and how points decoded from messages on matching topics are written
+type rule struct {
+	Topic       string            `json:"topic"`       // MQTT topic filter (may include + and # wildcards)
+	Bucket      string            `json:"bucket"`      // if set, replaces the bucket chosen by the decoder
+	Measurement string            `json:"measurement"` // if set, replaces the measurement chosen by the decoder
+	Tags        map[string]string `json:"tags"`        // tags added to every point (overriding decoded tags)
+	Conversions []conversion      `json:"conversions"` // unit conversions applied to the fields of every point
+	Types       map[string]string `json:"types"`       // type ("float" or "integer") values of these fields are written as
+	Encoding    string            `json:"encoding"`    // "cbor" or "msgpack" if payloads are binary encoded JSON
+	Timestamp   *timestampFormat  `json:"timestamp"`   // where point times come from and how payload timestamps are written
+	Deadband    *deadband         `json:"deadband"`    // only write fields that changed enough (or after a silence)
+	Aggregation *aggregation      `json:"aggregation"` // write one point per window instead of every point
+	Computed    []computedField   `json:"computed"`    // fields computed from the others by expressions
+	Integrate   []integration     `json:"integrate"`   // power fields integrated into cumulative energy fields
+}
+
+// duration is a time.Duration that is written in the rules file as a string such as "30s" or "5m"
+type duration time.Duration
+
+// newDuration returns a pointer to d as a duration (pointers distinguish "not set" from zero)
+func newDuration(d time.Duration) *duration {
+	v := duration(d)
+	return &v
+}
+
+// value returns the duration (0 if d is nil)
+func (d *duration) value() time.Duration {
+	if d == nil {
+		return 0
+	}
+	return time.Duration(*d)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// defaultSettings returns the settings used when no rules file is configured (or for anything it leaves out)
+func defaultSettings(cfg config) *settings {
+	s := &settings{
+		Solar: solarSettings{
+			TagKeys: []string{"status", "model_id", "model_length", "status_vendor_16", "status_vendor_32", "status_code"},
+			Fields: []solarFieldRule{
+				{Suffix: "_wh", Bucket: "latest_energy"},
+				{Suffix: "_w", Bucket: "latest_energy_current"},
+				{Suffix: "_va", Bucket: "latest_energy_current"},
+				{Suffix: "_var", Bucket: "latest_energy_current"},
+				{Suffix: "_pct", Bucket: "latest_energy_current"},
+				{Prefix: "ac_current_", Bucket: "latest_voltage_current"},
+				{Prefix: "ac_voltage_", Bucket: "latest_voltage_current"},
+				{Prefix: "dc_current_", Bucket: "latest_voltage_current"},
+				{Prefix: "dc_voltage_", Bucket: "latest_voltage_current"},
+				{Suffix: "_hz", Bucket: "latest_voltage_current"},
+				{Prefix: "temp_", Bucket: "sensors"},
+			},
+			Conversions: []conversion{
+				{Suffix: "_wh", From: "Wh", To: "kWh", Rename: "_kwh"},
+				{Suffix: "_w", From: "W", To: "kW", Rename: "_kw"},
+			},
+			// int16, uint16, int32 and uint32 sentinels
+			NotImplemented: []float64{-32768, 65535, -2147483648, 4294967295},
+		},
+		Victron: victronSettings{
+			SkipSuffixes:      []string{},
+			KeepaliveInterval: newDuration(30 * time.Second),
+		},
+		P1: p1Settings{
+			Measurement: "p1",
+		},
+		Values: valueSettings{
+			Integers: newBool(true),
+			Strings:  "field",
+		},
+		Zigbee2MQTT: zigbeeSettings{
+			BaseTopic:   "zigbee2mqtt",
+			Bucket:      "zigbee2mqtt",
+			Measurement: "zigbee2mqtt",
+			Exclude:     []string{"update", "last_seen"},
+			DeviceTags:  newBool(true),
+		},
+		Tasmota: tasmotaSettings{
+			Bucket:      "tasmota",
+			Measurement: "tasmota",
+			TimeZone:    "Local",
+		},
+		Shelly: shellySettings{
+			Bucket:      "shelly",
+			Measurement: "shelly",
+			Exclude:     []string{"id", "by_minute", "minute_ts"},
+		},
+		ContentTypes: map[string]string{
+			"application/json":                    formatJSON,
+			"text/plain":                          formatText,
+			"application/vnd.influx.lineprotocol": formatLineProtocol,
+			"application/x-protobuf":              formatProtobuf,
+			"application/protobuf":                formatProtobuf,
+			"application/cbor":                    formatCBOR,
+			"application/msgpack":                 formatMsgPack,
+			"application/x-msgpack":               formatMsgPack,
+			"application/vnd.msgpack":             formatMsgPack,
+		},
+		Sparkplug: sparkplugSettings{
+			Bucket:      "sparkplug",
+			Measurement: "sparkplug",
+			Exclude:     []string{"bdSeq", "Node Control/", "Device Control/"},
+		},
+		Precision: precisionSettings{
+			Default: "ns",
+		},
+		Dedup: dedupSettings{
+			Enabled:     newBool(false),
+			FlaggedOnly: newBool(true),
+			Size:        10000,
+			TTL:         newDuration(10 * time.Minute),
+			Persist:     newBool(true),
+			Retained:    retainedProcess,
+		},
+	}
+	if cfg.topic != "" {
+		s.Topics = []string{cfg.topic}
+	}
+	s.compile()
+	return s
+}
+
+// loadSettings reads the rules file named in the config (if any) on top of the defaults and validates the result
+func loadSettings(cfg config) (*settings, error) {
+	if cfg.rulesFile == "" {
+		return defaultSettings(cfg), nil
+	}
+
+	data, err := os.ReadFile(cfg.rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules file: %w", err)
+	}
+	// Decode into empty settings rather than the defaults; decoding into a populated slice would merge the file's
+	// entries into the default ones instead of replacing them
+	s := &settings{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("parsing rules file %s: %w", cfg.rulesFile, err)
+	}
+	s.setDefaults(defaultSettings(cfg))
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("rules file %s: %w", cfg.rulesFile, err)
+	}
+	s.compile()
+	return s, nil
+}
+
+// setDefaults fills in anything not given in the rules file from d
+func (s *settings) setDefaults(d *settings) {
+	if s.Topics == nil {
+		s.Topics = d.Topics
+	}
+	if s.Solar.TagKeys == nil {
+		s.Solar.TagKeys = d.Solar.TagKeys
+	}
+	if s.Solar.Fields == nil {
+		s.Solar.Fields = d.Solar.Fields
+	}
+	if s.Solar.Conversions == nil {
+		s.Solar.Conversions = d.Solar.Conversions
+	}
+	if s.Solar.NotImplemented == nil {
+		s.Solar.NotImplemented = d.Solar.NotImplemented
+	}
+	if s.Victron.SkipSuffixes == nil {
+		s.Victron.SkipSuffixes = d.Victron.SkipSuffixes
+	}
+	if s.Victron.KeepaliveInterval == nil {
+		s.Victron.KeepaliveInterval = d.Victron.KeepaliveInterval
+	}
+	if s.P1.Measurement == "" {
+		s.P1.Measurement = d.P1.Measurement
+	}
+	if s.Values.Integers == nil {
+		s.Values.Integers = d.Values.Integers
+	}
+	if s.Values.Strings == "" {
+		s.Values.Strings = d.Values.Strings
+	}
+	if s.Zigbee2MQTT.BaseTopic == "" {
+		s.Zigbee2MQTT.BaseTopic = d.Zigbee2MQTT.BaseTopic
+	}
+	if s.Zigbee2MQTT.Bucket == "" {
+		s.Zigbee2MQTT.Bucket = d.Zigbee2MQTT.Bucket
+	}
+	if s.Zigbee2MQTT.Measurement == "" {
+		s.Zigbee2MQTT.Measurement = d.Zigbee2MQTT.Measurement
+	}
+	if s.Zigbee2MQTT.Exclude == nil {
+		s.Zigbee2MQTT.Exclude = d.Zigbee2MQTT.Exclude
+	}
+	if s.Zigbee2MQTT.DeviceTags == nil {
+		s.Zigbee2MQTT.DeviceTags = d.Zigbee2MQTT.DeviceTags
+	}
+	if s.Tasmota.Bucket == "" {
+		s.Tasmota.Bucket = d.Tasmota.Bucket
+	}
+	if s.Tasmota.Measurement == "" {
+		s.Tasmota.Measurement = d.Tasmota.Measurement
+	}
+	if s.Tasmota.TimeZone == "" {
+		s.Tasmota.TimeZone = d.Tasmota.TimeZone
+	}
+	if s.Precision.Default == "" {
+		s.Precision.Default = d.Precision.Default
+	}
+	if s.Dedup.Enabled == nil {
+		s.Dedup.Enabled = d.Dedup.Enabled
+	}
+	if s.Dedup.FlaggedOnly == nil {
+		s.Dedup.FlaggedOnly = d.Dedup.FlaggedOnly
+	}
+	if s.Dedup.Size == 0 {
+		s.Dedup.Size = d.Dedup.Size
+	}
+	if s.Dedup.TTL == nil {
+		s.Dedup.TTL = d.Dedup.TTL
+	}
+	if s.Dedup.Persist == nil {
+		s.Dedup.Persist = d.Dedup.Persist
+	}
+	if s.Dedup.Retained == "" {
+		s.Dedup.Retained = d.Dedup.Retained
+	}
+	if s.Shelly.Bucket == "" {
+		s.Shelly.Bucket = d.Shelly.Bucket
+	}
+	if s.Shelly.Measurement == "" {
+		s.Shelly.Measurement = d.Shelly.Measurement
+	}
+	if s.Shelly.Exclude == nil {
+		s.Shelly.Exclude = d.Shelly.Exclude
+	}
+	if s.Sparkplug.Bucket == "" {
+		s.Sparkplug.Bucket = d.Sparkplug.Bucket
+	}
+	if s.Sparkplug.Measurement == "" {
+		s.Sparkplug.Measurement = d.Sparkplug.Measurement
+	}
+	if s.Sparkplug.Exclude == nil {
+		s.Sparkplug.Exclude = d.Sparkplug.Exclude
+	}
+	// Content types in the file are added to the default ones rather than replacing them
+	contentTypes := make(map[string]string, len(d.ContentTypes)+len(s.ContentTypes))
+	for contentType, format := range d.ContentTypes {
+		contentTypes[contentType] = format
+	}
+	for contentType, format := range s.ContentTypes {
+		contentTypes[strings.ToLower(contentType)] = format
+	}
+	s.ContentTypes = contentTypes
+}
+
+// validate checks that the settings can be applied
+func (s *settings) validate() error {
+	var errs []error
+	if len(s.Topics) == 0 {
+		errs = append(errs, errors.New("at least one topic is required"))
+	}
+	for _, topic := range s.Topics {
+		if err := validateTopicFilter(topic); err != nil {
+			errs = append(errs, fmt.Errorf("topics: %w", err))
+		}
+	}
+	for _, key := range s.Solar.TagKeys {
+		if key == "" {
+			errs = append(errs, errors.New("solar.tag_keys: empty key"))
+		}
+	}
+	for i, r := range s.Solar.Fields {
+		if r.Prefix == "" && r.Suffix == "" {
+			errs = append(errs, fmt.Errorf("solar.fields[%d]: prefix or suffix is required", i))
+		}
+		if r.Bucket == "" || r.Bucket == "tag" {
+			errs = append(errs, fmt.Errorf("solar.fields[%d]: invalid bucket %q", i, r.Bucket))
+		}
+	}
+	if s.Solar.UnknownBucket == "tag" {
+		errs = append(errs, errors.New(`solar.unknown_bucket: "tag" is reserved`))
+	}
+	errs = append(errs, validateConversions("solar.conversions", s.Solar.Conversions)...)
+	for _, suffix := range s.Victron.SkipSuffixes {
+		if suffix == "" {
+			errs = append(errs, errors.New("victron.skip_suffixes: empty suffix would skip every topic"))
+		}
+	}
+	if s.Victron.KeepaliveInterval != nil && s.Victron.KeepaliveInterval.value() < 0 {
+		errs = append(errs, errors.New("victron.keepalive_interval: must not be negative"))
+	}
+	for _, portal := range s.Victron.Portals {
+		if portal == "" || strings.ContainsAny(portal, "/+#") {
+			errs = append(errs, fmt.Errorf("victron.portals: invalid portal id %q", portal))
+		}
+	}
+	if !containsString(stringModes, s.Values.Strings) {
+		errs = append(errs, fmt.Errorf("values.strings: must be one of %s, got %q", strings.Join(stringModes, ", "), s.Values.Strings))
+	}
+	if strings.ContainsAny(s.Zigbee2MQTT.BaseTopic, "+#") || strings.HasSuffix(s.Zigbee2MQTT.BaseTopic, "/") {
+		errs = append(errs, fmt.Errorf("zigbee2mqtt.base_topic: invalid base topic %q", s.Zigbee2MQTT.BaseTopic))
+	}
+	if _, err := time.LoadLocation(s.Tasmota.TimeZone); err != nil {
+		errs = append(errs, fmt.Errorf("tasmota.time_zone: %w", err))
+	}
+	for _, prefix := range s.Sparkplug.Exclude {
+		if prefix == "" {
+			errs = append(errs, errors.New("sparkplug.exclude: empty prefix would exclude every metric"))
+		}
+	}
+	for i, t := range s.Scalars {
+		if err := t.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("scalars[%d]: %w", i, err))
+		}
+	}
+	for i, t := range s.LineProtocol {
+		if err := t.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("line_protocol[%d]: %w", i, err))
+		}
+	}
+	for contentType, format := range s.ContentTypes {
+		if !containsString(payloadFormats, format) {
+			errs = append(errs, fmt.Errorf("content_types: %q: unknown payload format %q (must be one of %s)",
+				contentType, format, strings.Join(payloadFormats, ", ")))
+		}
+	}
+	if _, ok := epochUnits[s.Precision.Default]; !ok {
+		errs = append(errs, fmt.Errorf("precision.default: unknown precision %q (must be one of s, ms, us, ns)", s.Precision.Default))
+	}
+	for bucket, precision := range s.Precision.Buckets {
+		if _, ok := epochUnits[precision]; !ok {
+			errs = append(errs, fmt.Errorf("precision.buckets: %q: unknown precision %q (must be one of s, ms, us, ns)", bucket, precision))
+		}
+	}
+	if s.Dedup.Size < 0 {
+		errs = append(errs, errors.New("dedup.size: must not be negative"))
+	}
+	if s.Dedup.TTL.value() <= 0 {
+		errs = append(errs, errors.New("dedup.ttl: must be positive"))
+	}
+	if !containsString(retainedPolicies, s.Dedup.Retained) {
+		errs = append(errs, fmt.Errorf("dedup.retained: must be one of %s, got %q", strings.Join(retainedPolicies, ", "), s.Dedup.Retained))
+	}
+	for i := range s.RateLimits {
+		if err := s.RateLimits[i].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rate_limits[%d]: %w", i, err))
+		}
+	}
+	for _, key := range s.UserPropertyTags {
+		if key == "" {
+			errs = append(errs, errors.New("user_property_tags: empty key"))
+		}
+	}
+	for i, r := range s.Rules {
+		if err := validateTopicFilter(r.Topic); err != nil {
+			errs = append(errs, fmt.Errorf("rules[%d]: %w", i, err))
+		}
+		for key := range r.Tags {
+			if key == "" {
+				errs = append(errs, fmt.Errorf("rules[%d]: empty tag key", i))
+			}
+		}
+		errs = append(errs, validateConversions(fmt.Sprintf("rules[%d].conversions", i), r.Conversions)...)
+		for field, typ := range r.Types {
+			if !containsString(fieldTypes, typ) {
+				errs = append(errs, fmt.Errorf("rules[%d].types: field %q: must be one of %s, got %q", i, field, strings.Join(fieldTypes, ", "), typ))
+			}
+		}
+		if r.Encoding != "" && !containsString(binaryEncodings, r.Encoding) {
+			errs = append(errs, fmt.Errorf("rules[%d]: unknown encoding %q (must be one of %s)", i, r.Encoding, strings.Join(binaryEncodings, ", ")))
+		}
+		if r.Timestamp != nil {
+			if err := r.Timestamp.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].timestamp: %w", i, err))
+			}
+		}
+		if r.Deadband != nil {
+			if err := r.Deadband.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].deadband: %w", i, err))
+			}
+		}
+		if r.Aggregation != nil {
+			if err := r.Aggregation.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].aggregation: %w", i, err))
+			}
+		}
+		for j := range r.Computed {
+			if err := r.Computed[j].validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].computed[%d]: %w", i, j, err))
+			}
+		}
+		for j := range r.Integrate {
+			if err := r.Integrate[j].validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].integrate[%d]: %w", i, j, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compile prepares lookup structures derived from the exported settings
+func (s *settings) compile() {
+	s.Solar.tagKeys = make(map[string]bool, len(s.Solar.TagKeys))
+	for _, key := range s.Solar.TagKeys {
+		s.Solar.tagKeys[key] = true
+	}
+	// The time zone of loaded settings has been checked by validate
+	if loc, err := time.LoadLocation(s.Tasmota.TimeZone); err == nil {
+		s.Tasmota.location = loc
+	} else {
+		s.Tasmota.location = time.Local
+	}
+	for _, r := range s.Rules {
+		if r.Timestamp != nil {
+			r.Timestamp.compile()
+		}
+		for j := range r.Computed {
+			r.Computed[j].compile()
+		}
+	}
+}
+
+// ruleFor returns the first rule whose topic filter matches topic (or nil if there is none)
+func (s *settings) ruleFor(topic string) *rule {
+	for i := range s.Rules {
+		if matchTopic(s.Rules[i].Topic, topic) {
+			return &s.Rules[i]
+		}
+	}
+	return nil
+}
+
+// addUserPropertyTags copies the user properties named in user_property_tags from msg onto the point's tags
+func (s *settings) addUserPropertyTags(msg *paho.Publish, point InfluxMessage) InfluxMessage {
+	if len(s.UserPropertyTags) == 0 || msg.Properties == nil || len(msg.Properties.User) == 0 {
+		return point
+	}
+	tags := make(map[string]string, len(point.Tags)+len(s.UserPropertyTags))
+	for k, v := range point.Tags {
+		tags[k] = v
+	}
+	for _, property := range msg.Properties.User {
+		if containsString(s.UserPropertyTags, property.Key) && property.Value != "" {
+			tags[property.Key] = property.Value
+		}
+	}
+	point.Tags = tags
+	return point
+}
+
+// apply returns the bucket and point after applying the rule
+func (r *rule) apply(bucket string, point InfluxMessage) (string, InfluxMessage) {
+	if r == nil {
+		return bucket, point
+	}
+	if r.Bucket != "" {
+		bucket = r.Bucket
+	}
+	if r.Measurement != "" {
+		point.Measurement = r.Measurement
+	}
+	if len(r.Tags) > 0 {
+		tags := make(map[string]string, len(point.Tags)+len(r.Tags))
+		for k, v := range point.Tags {
+			tags[k] = v
+		}
+		for k, v := range r.Tags {
+			tags[k] = v
+		}
+		point.Tags = tags
+	}
+	return bucket, applyTypes(r.Types, applyConversions(r.Conversions, point))
+}
+
+// diffSettings describes the differences between two sets of settings (one line per changed section)
+func diffSettings(old, updated *settings) []string {
+	var changes []string
+	section := func(name string, a, b interface{}) {
+		if reflect.DeepEqual(a, b) {
+			return
+		}
+		before, _ := json.Marshal(a)
+		after, _ := json.Marshal(b)
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, before, after))
+	}
+	section("topics", old.Topics, updated.Topics)
+	section("solar", old.Solar, updated.Solar)
+	section("victron", old.Victron, updated.Victron)
+	section("p1", old.P1, updated.P1)
+	section("values", old.Values, updated.Values)
+	section("zigbee2mqtt", old.Zigbee2MQTT, updated.Zigbee2MQTT)
+	section("tasmota", old.Tasmota, updated.Tasmota)
+	section("shelly", old.Shelly, updated.Shelly)
+	section("sparkplug", old.Sparkplug, updated.Sparkplug)
+	section("scalars", old.Scalars, updated.Scalars)
+	section("line_protocol", old.LineProtocol, updated.LineProtocol)
+	section("rules", old.Rules, updated.Rules)
+	section("precision", old.Precision, updated.Precision)
+	section("dedup", old.Dedup, updated.Dedup)
+	section("rate_limits", old.RateLimits, updated.RateLimits)
+	section("content_types", old.ContentTypes, updated.ContentTypes)
+	section("user_property_tags", old.UserPropertyTags, updated.UserPropertyTags)
+	return changes
+}
+
+// diffTopics returns the topics present in updated but not old, and those present in old but not updated
+func diffTopics(old, updated []string) (added, removed []string) {
+	for _, t := range updated {
+		if !containsString(old, t) {
+			added = append(added, t)
+		}
+	}
+	for _, t := range old {
+		if !containsString(updated, t) {
+			removed = append(removed, t)
+		}
+	}
+	return added, removed
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTopicFilter checks that filter is a valid MQTT topic filter
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.New("empty topic filter")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return fmt.Errorf("topic filter %q: # must be the last level", filter)
+		case level != "#" && level != "+" && strings.ContainsAny(level, "#+"):
+			return fmt.Errorf("topic filter %q: wildcards must occupy a whole level", filter)
+		}
+	}
+	return nil
+}
+
+// matchTopic reports whether topic matches the MQTT topic filter
+func matchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	// Topics starting with $ are not matched by a leading wildcard
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "#" || filterLevels[0] == "+") {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
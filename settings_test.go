@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func writeRulesFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write rules file: %v", err)
+	}
+	return path
+}
+
+func TestLoadSettings_DefaultsWithoutFile(t *testing.T) {
+	s, err := loadSettings(config{topic: "p1/#"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(s.Topics) != 1 || s.Topics[0] != "p1/#" {
+		t.Errorf("expected topics [p1/#], got %v", s.Topics)
+	}
+	if !s.Solar.tagKeys["status"] {
+		t.Error("expected status to be a default solar tag key")
+	}
+	if len(s.Victron.SkipSuffixes) != 0 {
+		t.Errorf("expected no default victron skip suffixes, got %v", s.Victron.SkipSuffixes)
+	}
+}
+
+func TestLoadSettings_FileOverridesDefaults(t *testing.T) {
+	path := writeRulesFile(t, `{
+		"topics": ["solaredge/#", "victron/#"],
+		"solar": {"tag_keys": ["status"]},
+		"victron": {"portals": ["a7f3c19de82b"]},
+		"rules": [{"topic": "victron/+/grid/#", "bucket": "grid", "tags": {"site": "home"}}]
+	}`)
+
+	s, err := loadSettings(config{topic: "p1/#", rulesFile: path})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(s.Topics) != 2 {
+		t.Errorf("expected topics from file, got %v", s.Topics)
+	}
+	if s.Solar.tagKeys["model_id"] {
+		t.Error("expected model_id to no longer be a solar tag key")
+	}
+	if s.Victron.SkipSuffixes == nil {
+		t.Error("expected victron skip suffixes to keep their default")
+	}
+	if s.Victron.KeepaliveInterval.value() != 30*time.Second {
+		t.Errorf("expected default keepalive interval 30s, got %v", s.Victron.KeepaliveInterval.value())
+	}
+	if r := s.ruleFor("victron/abc/grid/40/Ac/Power"); r == nil || r.Bucket != "grid" {
+		t.Errorf("expected grid rule to match, got %+v", r)
+	}
+}
+
+func TestLoadSettings_RejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"malformed json", `{"topics": [`},
+		{"unknown key", `{"topic": ["p1/#"]}`},
+		{"no topics", `{"topics": []}`},
+		{"misplaced multi-level wildcard", `{"topics": ["p1/#/x"]}`},
+		{"partial wildcard", `{"rules": [{"topic": "victron/a+/grid"}]}`},
+		{"empty skip suffix", `{"victron": {"skip_suffixes": [""]}}`},
+		{"invalid duration", `{"victron": {"keepalive_interval": "soon"}}`},
+		{"numeric duration", `{"victron": {"keepalive_interval": 30}}`},
+		{"invalid portal", `{"victron": {"portals": ["abc/#"]}}`},
+		{"unknown string mode", `{"values": {"strings": "ignore"}}`},
+		{"wildcard zigbee2mqtt base topic", `{"zigbee2mqtt": {"base_topic": "zigbee2mqtt/#"}}`},
+		{"unknown tasmota time zone", `{"tasmota": {"time_zone": "Europe/Atlantis"}}`},
+		{"empty sparkplug exclude prefix", `{"sparkplug": {"exclude": [""]}}`},
+		{"scalar template beyond topic", `{"scalars": [{"topic": "home/+", "bucket": "home", "measurement": "{3}"}]}`},
+		{"line protocol without bucket", `{"line_protocol": [{"topic": "telegraf/#"}]}`},
+		{"unknown payload format", `{"content_types": {"application/cbor": "cbor2"}}`},
+		{"empty user property tag", `{"user_property_tags": [""]}`},
+		{"negative dedup size", `{"dedup": {"size": -1}}`},
+		{"zero dedup ttl", `{"dedup": {"ttl": "0s"}}`},
+		{"unknown retained policy", `{"dedup": {"retained": "ignore"}}`},
+		{"unknown default precision", `{"precision": {"default": "min"}}`},
+		{"unknown bucket precision", `{"precision": {"buckets": {"p1": "seconds"}}}`},
+		{"aggregation without window", `{"rules": [{"topic": "victron/#", "aggregation": {"functions": ["mean"]}}]}`},
+		{"unknown aggregate function", `{"rules": [{"topic": "victron/#", "aggregation": {"window": "1m", "functions": ["median"]}}]}`},
+		{"rate limit without rate", `{"rate_limits": [{"topic": "sensors/#"}]}`},
+		{"unknown rate limit mode", `{"rate_limits": [{"topic": "sensors/#", "rate": 10, "mode": "queue"}]}`},
+		{"unknown rate limit scope", `{"rate_limits": [{"topic": "sensors/#", "rate": 10, "per": "device"}]}`},
+		{"invalid computed field expression", `{"rules": [{"topic": "p1/#", "computed": [{"name": "power_net", "expression": "power_delivered -"}]}]}`},
+		{"integration of a non-power unit", `{"rules": [{"topic": "solar/#", "integrate": [{"field": "ac_energy_wh", "unit": "Wh"}]}]}`},
+		{"unknown field type", `{"rules": [{"topic": "victron/#", "types": {"Soc": "double"}}]}`},
+		{"negative deadband", `{"rules": [{"topic": "victron/#", "deadband": {"absolute": -1}}]}`},
+		{"negative max silence", `{"rules": [{"topic": "victron/#", "deadband": {"max_silence": "-1m"}}]}`},
+		{"unknown timestamp source", `{"rules": [{"topic": "lora/#", "timestamp": {"source": "broker"}}]}`},
+		{"unknown timestamp unit", `{"rules": [{"topic": "lora/#", "timestamp": {"unit": "min"}}]}`},
+		{"unknown timestamp time zone", `{"rules": [{"topic": "lora/#", "timestamp": {"time_zone": "Mars/Olympus"}}]}`},
+		{"unknown rule encoding", `{"rules": [{"topic": "lora/#", "encoding": "protobuf"}]}`},
+		{"incompatible conversion", `{"rules": [{"topic": "victron/#", "conversions": [{"from": "W", "to": "°C"}]}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeRulesFile(t, tt.content)
+			if _, err := loadSettings(config{topic: "p1/#", rulesFile: path}); err == nil {
+				t.Fatal("expected error for invalid rules file")
+			}
+		})
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{"p1/#", "p1/meter", true},
+		{"p1/#", "p1", true},
+		{"p1/+", "p1/meter", true},
+		{"p1/+", "p1/meter/x", false},
+		{"victron/+/grid/#", "victron/abc/grid/40/Ac/Power", true},
+		{"victron/+/grid/#", "victron/abc/system/0", false},
+		{"#", "sensors/a/b/c", true},
+		{"#", "$SYS/broker", false},
+		{"sensors/temperature", "sensors/temperature", true},
+		{"sensors/temperature", "sensors", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := matchTopic(tt.filter, tt.topic); got != tt.expected {
+				t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRuleApply_DoesNotModifyDecodedTags(t *testing.T) {
+	tags := map[string]string{"location": "kitchen"}
+	r := &rule{Bucket: "home", Measurement: "climate", Tags: map[string]string{"site": "main"}}
+
+	bucket, point := r.apply("sensors", InfluxMessage{Measurement: "temperature", Tags: tags})
+	if bucket != "home" || point.Measurement != "climate" {
+		t.Errorf("expected bucket home and measurement climate, got %q and %q", bucket, point.Measurement)
+	}
+	if point.Tags["site"] != "main" || point.Tags["location"] != "kitchen" {
+		t.Errorf("expected merged tags, got %v", point.Tags)
+	}
+	if _, ok := tags["site"]; ok {
+		t.Error("rule tags must not be added to the decoder's tag map")
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	old := defaultSettings(config{topic: "p1/#"})
+	updated := defaultSettings(config{topic: "p1/#"})
+	if changes := diffSettings(old, updated); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+
+	updated.Topics = []string{"p1/#", "victron/#"}
+	updated.Victron.SkipSuffixes = []string{"Batteries"}
+	changes := diffSettings(old, updated)
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", changes)
+	}
+	if !strings.HasPrefix(changes[0], "topics:") || !strings.HasPrefix(changes[1], "victron:") {
+		t.Errorf("unexpected change descriptions: %v", changes)
+	}
+
+	added, removed := diffTopics([]string{"p1/#", "sensors/#"}, []string{"p1/#", "victron/#"})
+	if len(added) != 1 || added[0] != "victron/#" || len(removed) != 1 || removed[0] != "sensors/#" {
+		t.Errorf("expected added [victron/#] and removed [sensors/#], got %v and %v", added, removed)
+	}
+}
+
+func TestHandle_UsesSwappedSettings(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+
+	path := writeRulesFile(t, `{"rules": [{"topic": "victron/+/grid/#", "bucket": "grid"}]}`)
+	s, err := loadSettings(config{topic: "victron/#", rulesFile: path})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if changes := h.swapSettings(s); len(changes) != 2 {
+		t.Errorf("expected topic and rule changes, got %v", changes)
+	}
+
+	h.handle(&paho.Publish{
+		Topic:   "victron/a7f3c19de82b/grid/40/Ac/L3/Power",
+		Payload: []byte(`{"value": -1393, "timestamp": 1782637540236}`),
+	})
+	if _, err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if _, ok := h.writeAPIs["grid"]; !ok {
+		t.Errorf("expected point to be written to the grid bucket, got buckets %v", h.writeAPIs)
+	}
+}
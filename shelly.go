@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// shellyNotification is a Gen2 RPC notification as published on <prefix>/events/rpc
+type shellyNotification struct {
+	Src    string                 `json:"src"`    // device ID, e.g. shellyplus1pm-a8032ab12345
+	Method string                 `json:"method"` // NotifyStatus, NotifyFullStatus or NotifyEvent
+	Params map[string]interface{} `json:"params"` // ts (unix seconds) and the changed components
+}
+
+// errNoShellyStatus is returned for notifications that do not carry component status (such as NotifyEvent)
+var errNoShellyStatus = errors.New("notification has no status")
+
+// shellyTimestamps is the format of the ts member of Gen2 notifications: seconds since the epoch with a fraction
+var shellyTimestamps = timestampFormat{Unit: "s"}
+
+// buildShellyPoint decodes a Shelly Gen2 NotifyStatus (or NotifyFullStatus) notification. Components are flattened
+// into fields named <component>/<reading> (e.g. switch:0/apower, switch:0/aenergy/total); strings and members whose
+// name is in cfg.Exclude are skipped. The notification's ts is used as the point time if present.
+func buildShellyPoint(cfg shellySettings, values valueSettings, payload []byte, at timestamps) (InfluxMessage, error) {
+	var notification shellyNotification
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&notification); err != nil {
+		return InfluxMessage{}, err
+	}
+	if notification.Method != "NotifyStatus" && notification.Method != "NotifyFullStatus" {
+		return InfluxMessage{}, errNoShellyStatus
+	}
+	if notification.Src == "" {
+		return InfluxMessage{}, errors.New("notification has no src")
+	}
+
+	timestamp, err := at.parse(notification.Params["ts"], shellyTimestamps)
+	if err != nil {
+		return InfluxMessage{}, fmt.Errorf("invalid ts: %w", err)
+	}
+
+	tags := map[string]string{"device": notification.Src}
+	values.Strings = "skip"
+	fields := make(map[string]interface{})
+	for key, val := range notification.Params {
+		if key == "ts" {
+			continue
+		}
+		flattenValue(values, key, val, fields, tags)
+	}
+	for key := range fields {
+		for _, name := range strings.Split(key, "/")[1:] {
+			if containsString(cfg.Exclude, name) {
+				delete(fields, key)
+				break
+			}
+		}
+	}
+
+	return InfluxMessage{
+		Measurement: cfg.Measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        timestamp,
+	}, nil
+}
+
+// handleShellyMessage writes the component status reported by a Shelly Gen2 device
+func (o *handler) handleShellyMessage(s *settings, msg *paho.Publish, at timestamps) {
+	point, err := buildShellyPoint(s.Shelly, s.Values, msg.Payload, at)
+	if errors.Is(err, errNoShellyStatus) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Shelly message could not be parsed (%s): %s\n", msg.Topic, err)
+		return
+	}
+	if len(point.Fields) == 0 {
+		return
+	}
+	o.emit(s, msg, s.Shelly.Bucket, point)
+}
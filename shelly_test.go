@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBuildShellyPoint(t *testing.T) {
+	s := defaultSettings(config{})
+	payload := []byte(`{"src": "shellyplus1pm-a8032ab12345", "dst": "shellyplus1pm-a8032ab12345/events",
+		"method": "NotifyStatus", "params": {"ts": 1777636800.25, "switch:0": {"id": 0, "apower": 12.3,
+		"voltage": 230.1, "output": true, "aenergy": {"total": 1234.567, "by_minute": [1.2, 0, 0], "minute_ts": 1777636800},
+		"temperature": {"tC": 40.1, "tF": 104.2}, "source": "button"}}}`)
+
+	point, err := buildShellyPoint(s.Shelly, s.Values, payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildShellyPoint returned error: %v", err)
+	}
+	if point.Measurement != "shelly" || point.Tags["device"] != "shellyplus1pm-a8032ab12345" {
+		t.Errorf("unexpected measurement or tags: %q %v", point.Measurement, point.Tags)
+	}
+	if !point.Time.Equal(time.UnixMilli(1777636800250)) {
+		t.Errorf("expected notification ts, got %v", point.Time)
+	}
+	expected := map[string]interface{}{
+		"switch:0/apower": 12.3, "switch:0/voltage": 230.1, "switch:0/output": true, "switch:0/aenergy/total": 1234.567,
+		"switch:0/temperature/tC": 40.1, "switch:0/temperature/tF": 104.2,
+	}
+	if len(point.Fields) != len(expected) {
+		t.Fatalf("expected fields %v, got %v", expected, point.Fields)
+	}
+	for key, val := range expected {
+		if point.Fields[key] != val {
+			t.Errorf("expected %s=%v, got %v", key, val, point.Fields[key])
+		}
+	}
+}
+
+func TestBuildShellyPoint_IgnoresEvents(t *testing.T) {
+	s := defaultSettings(config{})
+	payload := []byte(`{"src": "shellyplus1pm-a8032ab12345", "method": "NotifyEvent",
+		"params": {"ts": 1777636800.25, "events": [{"component": "input:0", "event": "single_push"}]}}`)
+	if _, err := buildShellyPoint(s.Shelly, s.Values, payload, receivedAt(time.Now())); !errors.Is(err, errNoShellyStatus) {
+		t.Errorf("expected errNoShellyStatus, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/eclipse/paho.golang/paho"
 )
@@ -43,7 +44,7 @@ func TestClassifySolarField(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.key, func(t *testing.T) {
-			got := classifySolarField(tt.key)
+			got := classifySolarField(defaultSettings(config{}).Solar, tt.key)
 			if got != tt.expected {
 				t.Errorf("classifySolarField(%q) = %q, want %q", tt.key, got, tt.expected)
 			}
@@ -84,7 +85,7 @@ func TestBuildSolarPoints_ParsesAndRoutesFields(t *testing.T) {
 		t.Fatalf("failed to marshal test payload: %v", err)
 	}
 
-	written, err := buildSolarPoints(payloadBytes)
+	written, err := buildSolarPoints(defaultSettings(config{}).Solar, payloadBytes, receivedAt(time.Now()))
 	if err != nil {
 		t.Fatalf("buildSolarPoints failed: %v", err)
 	}
@@ -142,7 +143,9 @@ func TestHandleSolarMessage_InvalidPayload(t *testing.T) {
 	handleSolarMessage(msg, nil, "test-org")
 }
 
-func TestTransformSolarValue(t *testing.T) {
+func TestSolarDefaultConversions(t *testing.T) {
+	conversions := defaultSettings(config{}).Solar.Conversions
+
 	tests := []struct {
 		name        string
 		key         string
@@ -163,12 +166,12 @@ func TestTransformSolarValue(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotKey, gotVal := transformSolarValue(tt.key, tt.val)
+			gotKey, gotVal, _ := convertField(conversions, tt.key, tt.val, "")
 			if gotKey != tt.expectedKey {
-				t.Errorf("transformSolarValue(%q, %v) key = %q, want %q", tt.key, tt.val, gotKey, tt.expectedKey)
+				t.Errorf("convertField(%q, %v) key = %q, want %q", tt.key, tt.val, gotKey, tt.expectedKey)
 			}
 			if gotVal != tt.expectedVal {
-				t.Errorf("transformSolarValue(%q, %v) val = %v, want %v", tt.key, tt.val, gotVal, tt.expectedVal)
+				t.Errorf("convertField(%q, %v) val = %v, want %v", tt.key, tt.val, gotVal, tt.expectedVal)
 			}
 		})
 	}
@@ -191,7 +194,7 @@ func TestBuildSolarPoints_WattValuesConvertedToKilowatt(t *testing.T) {
 		t.Fatalf("failed to marshal test payload: %v", err)
 	}
 
-	points, err := buildSolarPoints(payloadBytes)
+	points, err := buildSolarPoints(defaultSettings(config{}).Solar, payloadBytes, receivedAt(time.Now()))
 	if err != nil {
 		t.Fatalf("buildSolarPoints failed: %v", err)
 	}
@@ -223,3 +226,106 @@ func TestBuildSolarPoints_WattValuesConvertedToKilowatt(t *testing.T) {
 		t.Errorf("expected temp_sink_c=45.0 unchanged, got %v", sensorBucket.Fields["temp_sink_c"])
 	}
 }
+
+func TestClassifySolarField_ConfiguredRules(t *testing.T) {
+	path := writeRulesFile(t, `{"solar": {
+		"tag_keys": ["status"],
+		"fields": [
+			{"prefix": "battery_", "bucket": "battery"},
+			{"prefix": "meter_", "suffix": "_wh", "bucket": "meter_energy"},
+			{"suffix": "_wh", "bucket": "latest_energy"}
+		],
+		"unknown_bucket": "solar_other"
+	}}`)
+	s, err := loadSettings(config{topic: "solaredge/#", rulesFile: path})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"status", "tag"},
+		{"model_id", "solar_other"},
+		{"battery_soc_pct", "battery"},
+		{"meter_import_wh", "meter_energy"},
+		{"ac_energy_wh", "latest_energy"},
+		{"ac_power_w", "solar_other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := classifySolarField(s.Solar, tt.key); got != tt.expected {
+				t.Errorf("classifySolarField(%q) = %q, want %q", tt.key, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildSolarPoints_UnknownFieldsUseCatchAllBucket(t *testing.T) {
+	cfg := defaultSettings(config{}).Solar
+	payload := []byte(`{"model": "SE2200H/inverter", "source": "SE2200H", "timestamp": 1779634500,
+		"data": {"ac_power_w": 1000, "battery_soc": 80}}`)
+
+	points, err := buildSolarPoints(cfg, payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildSolarPoints failed: %v", err)
+	}
+	if len(points) != 1 {
+		t.Errorf("expected unknown field to be skipped by default, got buckets %v", points)
+	}
+
+	cfg.UnknownBucket = "solar_other"
+	points, err = buildSolarPoints(cfg, payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildSolarPoints failed: %v", err)
+	}
+	if points["solar_other"].Fields["battery_soc"] != float64(80) {
+		t.Errorf("expected battery_soc=80 in solar_other bucket, got %v", points["solar_other"].Fields)
+	}
+}
+
+func TestBuildSolarPoints_AppliesSunSpecScaleFactors(t *testing.T) {
+	payload := []byte(`{"model": "SE2200H/inverter", "source": "SE2200H", "timestamp": 1779634500, "data": {
+		"ac_current_a": 480, "ac_current_b": 65535, "ac_current_sf": -2,
+		"ac_power_w": 1154, "ac_power_sf": 1,
+		"ac_energy_wh": 6679718, "ac_energy_wh_sf": 0,
+		"ac_voltage_an": 2406, "ac_voltage_sf": -32768,
+		"temp_sink_c": 4514, "temp_sf": -2,
+		"dc_power_w": 1171.6
+	}}`)
+
+	points, err := buildSolarPoints(defaultSettings(config{}).Solar, payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildSolarPoints failed: %v", err)
+	}
+
+	voltageCurrent := points["latest_voltage_current"].Fields
+	if voltageCurrent["ac_current_a"] != float64(4.8) {
+		t.Errorf("expected ac_current_a=4.8 after scaling, got %v", voltageCurrent["ac_current_a"])
+	}
+	if _, ok := voltageCurrent["ac_current_b"]; ok {
+		t.Error("expected not-implemented ac_current_b to be skipped")
+	}
+	if _, ok := voltageCurrent["ac_voltage_an"]; ok {
+		t.Error("expected ac_voltage_an with a not-implemented scale factor to be skipped")
+	}
+	if _, ok := voltageCurrent["ac_current_sf"]; ok {
+		t.Error("scale factors must not be stored as fields")
+	}
+
+	// Scale factors are applied before the W -> kW conversion
+	power := points["latest_energy_current"].Fields
+	if power["ac_power_kw"] != float64(11.54) {
+		t.Errorf("expected ac_power_kw=11.54, got %v", power["ac_power_kw"])
+	}
+	if power["dc_power_kw"] != float64(1.1716) {
+		t.Errorf("expected unscaled dc_power_kw=1.1716, got %v", power["dc_power_kw"])
+	}
+	if points["latest_energy"].Fields["ac_energy_kwh"] != float64(6679.718) {
+		t.Errorf("expected ac_energy_kwh=6679.718, got %v", points["latest_energy"].Fields["ac_energy_kwh"])
+	}
+	if points["sensors"].Fields["temp_sink_c"] != float64(45.14) {
+		t.Errorf("expected temp_sink_c=45.14, got %v", points["sensors"].Fields["temp_sink_c"])
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B messages are published on spBv1.0/<group>/<message type>/<edge node>[/<device>] with a protobuf
+// payload (see sparkplug_b.proto in the Eclipse Tahu project). Births list every metric with its name, alias and
+// datatype; data messages may refer to metrics by alias only, so the aliases are remembered per edge node.
+
+// sparkplugTopic holds the parts of a Sparkplug B topic
+type sparkplugTopic struct {
+	group       string
+	messageType string // NBIRTH, NDEATH, DBIRTH, DDEATH, NDATA, DDATA, NCMD, DCMD
+	edgeNode    string
+	device      string // blank for node messages
+}
+
+// node returns the key of the edge node the message belongs to
+func (t sparkplugTopic) node() string {
+	return t.group + "/" + t.edgeNode
+}
+
+// parseSparkplugTopic splits a Sparkplug B topic
+func parseSparkplugTopic(topic string) (sparkplugTopic, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != "spBv1.0" {
+		return sparkplugTopic{}, fmt.Errorf("topic is not in the correct format: %s", topic)
+	}
+	t := sparkplugTopic{group: parts[1], messageType: parts[2], edgeNode: parts[3]}
+	if len(parts) == 5 {
+		t.device = parts[4]
+	}
+	if (t.device != "") != strings.HasPrefix(t.messageType, "D") {
+		return sparkplugTopic{}, fmt.Errorf("topic %s: %s message with the wrong number of levels", topic, t.messageType)
+	}
+	return t, nil
+}
+
+// Sparkplug B datatypes (the ones that can be written to InfluxDB)
+const (
+	sparkplugInt8     = 1
+	sparkplugInt16    = 2
+	sparkplugInt32    = 3
+	sparkplugInt64    = 4
+	sparkplugUInt8    = 5
+	sparkplugUInt16   = 6
+	sparkplugUInt32   = 7
+	sparkplugUInt64   = 8
+	sparkplugFloat    = 9
+	sparkplugDouble   = 10
+	sparkplugBoolean  = 11
+	sparkplugString   = 12
+	sparkplugDateTime = 13
+	sparkplugText     = 14
+	sparkplugUUID     = 15
+)
+
+// sparkplugMetric is a decoded Metric message
+type sparkplugMetric struct {
+	name      string
+	alias     uint64
+	hasAlias  bool
+	timestamp uint64 // ms since the epoch (0 if not given)
+	datatype  uint32 // 0 if not given (data messages may leave it out)
+	isNull    bool
+
+	// raw value; which one is set depends on the datatype
+	intValue    uint64
+	floatValue  uint32
+	doubleValue uint64
+	boolValue   bool
+	stringValue string
+	hasValue    bool
+}
+
+// sparkplugPayload is a decoded Payload message
+type sparkplugPayload struct {
+	timestamp uint64 // ms since the epoch (0 if not given)
+	seq       uint64
+	metrics   []sparkplugMetric
+}
+
+// protoFields calls fn for every field of an encoded protobuf message. v holds the value of varint and fixed
+// fields, b the contents of length-delimited ones.
+func protoFields(data []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var v uint64
+		var b []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(data)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(num, typ, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSparkplugMetric decodes a Metric message. Metadata, properties, datasets and templates are skipped.
+func parseSparkplugMetric(data []byte) (sparkplugMetric, error) {
+	var m sparkplugMetric
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			m.name = string(b)
+		case 2:
+			m.alias, m.hasAlias = v, true
+		case 3:
+			m.timestamp = v
+		case 4:
+			m.datatype = uint32(v)
+		case 7:
+			m.isNull = v != 0
+		case 10, 11:
+			m.intValue, m.hasValue = v, true
+		case 12:
+			m.floatValue, m.hasValue = uint32(v), true
+		case 13:
+			m.doubleValue, m.hasValue = v, true
+		case 14:
+			m.boolValue, m.hasValue = v != 0, true
+		case 15:
+			m.stringValue, m.hasValue = string(b), true
+		}
+		return nil
+	})
+	return m, err
+}
+
+// parseSparkplugPayload decodes a Payload message
+func parseSparkplugPayload(data []byte) (sparkplugPayload, error) {
+	var p sparkplugPayload
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			p.timestamp = v
+		case 2:
+			if typ != protowire.BytesType {
+				return errors.New("metric is not a message")
+			}
+			m, err := parseSparkplugMetric(b)
+			if err != nil {
+				return fmt.Errorf("metric %d: %w", len(p.metrics), err)
+			}
+			p.metrics = append(p.metrics, m)
+		case 3:
+			p.seq = v
+		}
+		return nil
+	})
+	return p, err
+}
+
+// value returns the metric's value as it is written to InfluxDB. ok is false for null metrics and datatypes that
+// cannot be written (datasets, templates, bytes and files).
+func (m sparkplugMetric) value(datatype uint32) (interface{}, bool) {
+	if m.isNull || !m.hasValue {
+		return nil, false
+	}
+	switch datatype {
+	case sparkplugInt8:
+		return int64(int8(m.intValue)), true
+	case sparkplugInt16:
+		return int64(int16(m.intValue)), true
+	case sparkplugInt32:
+		return int64(int32(m.intValue)), true
+	case sparkplugInt64:
+		return int64(m.intValue), true
+	case sparkplugUInt8, sparkplugUInt16, sparkplugUInt32:
+		return int64(uint32(m.intValue)), true
+	case sparkplugUInt64:
+		return m.intValue, true
+	case sparkplugDateTime:
+		return int64(m.intValue), true
+	case sparkplugFloat:
+		return float64(math.Float32frombits(m.floatValue)), true
+	case sparkplugDouble:
+		return math.Float64frombits(m.doubleValue), true
+	case sparkplugBoolean:
+		return m.boolValue, true
+	case sparkplugString, sparkplugText, sparkplugUUID:
+		return m.stringValue, true
+	}
+	return nil, false
+}
+
+// sparkplugMetricInfo is what a birth certificate says about a metric
+type sparkplugMetricInfo struct {
+	name     string
+	datatype uint32
+}
+
+// sparkplugNode holds what has been learnt from an edge node's birth certificates
+type sparkplugNode struct {
+	bdSeq   uint64                         // birth/death sequence number of the current session
+	aliases map[uint64]sparkplugMetricInfo // metric alias → name and datatype (for the node and all its devices)
+	types   map[string]uint32              // metric name → datatype
+	devices map[string]bool                // devices born in the current session
+}
+
+// sparkplugTimestamps is the format of Sparkplug timestamps: milliseconds since the epoch
+var sparkplugTimestamps = timestampFormat{Unit: "ms"}
+
+// sparkplugTime converts a Sparkplug timestamp to a time, using fallback if it is not set (or cannot be converted)
+func sparkplugTime(at timestamps, ms uint64, fallback time.Time) time.Time {
+	at.received = fallback
+	t, err := at.parse(ms, sparkplugTimestamps)
+	if err != nil {
+		return fallback
+	}
+	return t
+}
+
+// buildSparkplugPoints turns the metrics of a birth or data message into points: one per distinct metric timestamp,
+// tagged with the group, edge node and device. Metric names and datatypes missing from data messages are looked up
+// in node; metrics that cannot be resolved or written are skipped and reported in the returned error.
+func buildSparkplugPoints(cfg sparkplugSettings, values valueSettings, t sparkplugTopic, payload sparkplugPayload, node *sparkplugNode, at timestamps) ([]InfluxMessage, error) {
+	tags := map[string]string{"group": t.group, "edge_node": t.edgeNode}
+	if t.device != "" {
+		tags["device"] = t.device
+	}
+	timestamp := sparkplugTime(at, payload.timestamp, at.received)
+
+	var errs []error
+	points := make(map[int64]*InfluxMessage) // by UnixNano of the point time
+	for _, m := range payload.metrics {
+		name, datatype := m.name, m.datatype
+		if name == "" && m.hasAlias && node != nil {
+			info, ok := node.aliases[m.alias]
+			if !ok {
+				errs = append(errs, fmt.Errorf("unknown alias %d", m.alias))
+				continue
+			}
+			name = info.name
+			if datatype == 0 {
+				datatype = info.datatype
+			}
+		}
+		if name == "" {
+			errs = append(errs, errors.New("metric without name or known alias"))
+			continue
+		}
+		if datatype == 0 && node != nil {
+			datatype = node.types[name]
+		}
+		if cfg.excluded(name) {
+			continue
+		}
+		val, ok := m.value(datatype)
+		if !ok {
+			continue
+		}
+
+		metricTime := sparkplugTime(at, m.timestamp, timestamp)
+		point, ok := points[metricTime.UnixNano()]
+		if !ok {
+			pointTags := make(map[string]string, len(tags))
+			for k, v := range tags {
+				pointTags[k] = v
+			}
+			point = &InfluxMessage{Measurement: cfg.Measurement, Tags: pointTags, Fields: map[string]interface{}{}, Time: metricTime}
+			points[metricTime.UnixNano()] = point
+		}
+		if s, isString := val.(string); isString {
+			switch values.Strings {
+			case "field":
+				point.Fields[name] = s
+			case "tag":
+				point.Tags[name] = s
+			}
+			continue
+		}
+		point.Fields[name] = val
+	}
+
+	result := make([]InfluxMessage, 0, len(points))
+	for _, point := range points {
+		if len(point.Fields) > 0 {
+			result = append(result, *point)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, errors.Join(errs...)
+}
+
+// sparkplugStatusPoint returns the point recording that an edge node or device came online or went offline
+func sparkplugStatusPoint(cfg sparkplugSettings, t sparkplugTopic, device string, online bool, at time.Time) InfluxMessage {
+	tags := map[string]string{"group": t.group, "edge_node": t.edgeNode}
+	if device != "" {
+		tags["device"] = device
+	}
+	return InfluxMessage{
+		Measurement: cfg.Measurement,
+		Tags:        tags,
+		Fields:      map[string]interface{}{"online": online},
+		Time:        at,
+	}
+}
+
+// learnSparkplugBirth records the aliases and datatypes of a birth certificate. An NBIRTH starts a new session for
+// the edge node, forgetting what earlier births said.
+func (o *handler) learnSparkplugBirth(t sparkplugTopic, payload sparkplugPayload) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.sparkplugNodes == nil {
+		o.sparkplugNodes = make(map[string]*sparkplugNode)
+	}
+	node := o.sparkplugNodes[t.node()]
+	if node == nil || t.messageType == "NBIRTH" {
+		node = &sparkplugNode{
+			aliases: make(map[uint64]sparkplugMetricInfo),
+			types:   make(map[string]uint32),
+			devices: make(map[string]bool),
+		}
+		o.sparkplugNodes[t.node()] = node
+	}
+	for _, m := range payload.metrics {
+		if m.name == "" {
+			continue
+		}
+		if m.hasAlias {
+			node.aliases[m.alias] = sparkplugMetricInfo{name: m.name, datatype: m.datatype}
+		}
+		node.types[m.name] = m.datatype
+		if t.messageType == "NBIRTH" && m.name == "bdSeq" {
+			node.bdSeq = m.intValue
+		}
+	}
+	if t.device != "" {
+		node.devices[t.device] = true
+	}
+}
+
+// sparkplugDeath handles a death certificate and returns the devices that went offline ("" for the node itself).
+// An NDEATH whose bdSeq does not match the current session is a late will message from an earlier session and is
+// ignored.
+func (o *handler) sparkplugDeath(t sparkplugTopic, payload sparkplugPayload) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	node := o.sparkplugNodes[t.node()]
+	if t.messageType == "DDEATH" {
+		if node != nil {
+			delete(node.devices, t.device)
+		}
+		return []string{t.device}
+	}
+
+	for _, m := range payload.metrics {
+		if m.name == "bdSeq" && node != nil && m.intValue != node.bdSeq {
+			return nil
+		}
+	}
+	offline := []string{""}
+	if node != nil {
+		for device := range node.devices {
+			offline = append(offline, device)
+		}
+		sort.Strings(offline[1:])
+	}
+	delete(o.sparkplugNodes, t.node())
+	return offline
+}
+
+// handleSparkplugMessage decodes a Sparkplug B message: births teach aliases and mark the node or device online,
+// data messages are written as points and deaths mark the node (and its devices) or device offline
+func (o *handler) handleSparkplugMessage(s *settings, msg *paho.Publish, at timestamps) {
+	cfg := s.Sparkplug
+	t, err := parseSparkplugTopic(msg.Topic)
+	if err != nil {
+		if !strings.HasPrefix(msg.Topic, "spBv1.0/STATE/") {
+			fmt.Printf("Sparkplug message could not be parsed: %s\n", err)
+		}
+		return
+	}
+	if t.messageType == "NCMD" || t.messageType == "DCMD" {
+		return
+	}
+	payload, err := parseSparkplugPayload(msg.Payload)
+	if err != nil {
+		fmt.Printf("Sparkplug payload could not be parsed (%s): %s\n", msg.Topic, err)
+		return
+	}
+	timestamp := sparkplugTime(at, payload.timestamp, at.received)
+
+	switch t.messageType {
+	case "NBIRTH", "DBIRTH":
+		o.learnSparkplugBirth(t, payload)
+		o.emit(s, msg, cfg.Bucket, sparkplugStatusPoint(cfg, t, t.device, true, timestamp))
+	case "NDEATH", "DDEATH":
+		// An NDEATH is the will message built when the node connected, so its timestamp can be that of the birth;
+		// the status is written at the receive time so that it does not overwrite online=true
+		for _, device := range o.sparkplugDeath(t, payload) {
+			o.emit(s, msg, cfg.Bucket, sparkplugStatusPoint(cfg, t, device, false, at.received))
+		}
+		return
+	case "NDATA", "DDATA":
+		// written below
+	default:
+		fmt.Printf("Unknown Sparkplug message type %s on topic %s\n", t.messageType, msg.Topic)
+		return
+	}
+
+	o.mu.Lock()
+	points, err := buildSparkplugPoints(cfg, s.Values, t, payload, o.sparkplugNodes[t.node()], at)
+	o.mu.Unlock()
+	if err != nil {
+		fmt.Printf("Sparkplug metrics skipped (%s): %s\n", msg.Topic, err)
+	}
+	for _, point := range points {
+		o.emit(s, msg, cfg.Bucket, point)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testMetric describes a metric to encode; value is an int64, uint64, float32, float64, bool or string
+type testMetric struct {
+	name      string
+	alias     uint64
+	datatype  uint32
+	timestamp uint64
+	value     interface{}
+}
+
+// encodeSparkplugPayload encodes a Sparkplug B payload the way an edge node would
+func encodeSparkplugPayload(timestamp uint64, metrics ...testMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, timestamp)
+	for _, m := range metrics {
+		var mb []byte
+		if m.name != "" {
+			mb = protowire.AppendTag(mb, 1, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.name)
+		}
+		if m.alias != 0 {
+			mb = protowire.AppendTag(mb, 2, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.alias)
+		}
+		if m.timestamp != 0 {
+			mb = protowire.AppendTag(mb, 3, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.timestamp)
+		}
+		if m.datatype != 0 {
+			mb = protowire.AppendTag(mb, 4, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(m.datatype))
+		}
+		switch v := m.value.(type) {
+		case int64:
+			if m.datatype == sparkplugInt64 {
+				mb = protowire.AppendTag(mb, 11, protowire.VarintType)
+				mb = protowire.AppendVarint(mb, uint64(v))
+			} else {
+				mb = protowire.AppendTag(mb, 10, protowire.VarintType)
+				mb = protowire.AppendVarint(mb, uint64(uint32(v)))
+			}
+		case uint64:
+			mb = protowire.AppendTag(mb, 11, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, v)
+		case float32:
+			mb = protowire.AppendTag(mb, 12, protowire.Fixed32Type)
+			mb = protowire.AppendFixed32(mb, math.Float32bits(v))
+		case float64:
+			mb = protowire.AppendTag(mb, 13, protowire.Fixed64Type)
+			mb = protowire.AppendFixed64(mb, math.Float64bits(v))
+		case bool:
+			mb = protowire.AppendTag(mb, 14, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, protowire.EncodeBool(v))
+		case string:
+			mb = protowire.AppendTag(mb, 15, protowire.BytesType)
+			mb = protowire.AppendString(mb, v)
+		case nil:
+			mb = protowire.AppendTag(mb, 7, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, 1)
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, 0)
+	return b
+}
+
+func TestParseSparkplugTopic(t *testing.T) {
+	topic, err := parseSparkplugTopic("spBv1.0/plant1/DDATA/line3/press7")
+	if err != nil {
+		t.Fatalf("parseSparkplugTopic returned error: %v", err)
+	}
+	if topic.group != "plant1" || topic.messageType != "DDATA" || topic.edgeNode != "line3" || topic.device != "press7" {
+		t.Errorf("unexpected topic parts: %+v", topic)
+	}
+	for _, invalid := range []string{"spBv1.0/plant1/NDATA", "spBv1.0/plant1/NDATA/line3/press7", "spBv1.0/plant1/DDATA/line3"} {
+		if _, err := parseSparkplugTopic(invalid); err == nil {
+			t.Errorf("expected error for topic %q", invalid)
+		}
+	}
+}
+
+func TestBuildSparkplugPoints_DatatypesAndTimestamps(t *testing.T) {
+	s := defaultSettings(config{})
+	topic := sparkplugTopic{group: "plant1", messageType: "NDATA", edgeNode: "line3"}
+	payload, err := parseSparkplugPayload(encodeSparkplugPayload(1777636800000,
+		testMetric{name: "Temperature", datatype: sparkplugFloat, value: float32(21.5)},
+		testMetric{name: "Offset", datatype: sparkplugInt16, value: int64(-12)},
+		testMetric{name: "Count", datatype: sparkplugUInt64, value: uint64(math.MaxUint64)},
+		testMetric{name: "Running", datatype: sparkplugBoolean, value: true},
+		testMetric{name: "Recipe", datatype: sparkplugString, value: "PX-200"},
+		testMetric{name: "Pressure", datatype: sparkplugDouble, value: 4.25, timestamp: 1777636799000},
+		testMetric{name: "Spare", datatype: sparkplugDouble, value: nil},
+		testMetric{name: "Node Control/Rebirth", datatype: sparkplugBoolean, value: false},
+	))
+	if err != nil {
+		t.Fatalf("parseSparkplugPayload returned error: %v", err)
+	}
+
+	points, err := buildSparkplugPoints(s.Sparkplug, s.Values, topic, payload, nil, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildSparkplugPoints returned error: %v", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("expected a point per metric timestamp, got %v", points)
+	}
+	if points[0].Fields["Pressure"] != 4.25 || !points[0].Time.Equal(time.UnixMilli(1777636799000)) {
+		t.Errorf("expected Pressure at its own timestamp, got %v", points[0])
+	}
+	expected := map[string]interface{}{
+		"Temperature": 21.5, "Offset": int64(-12), "Count": uint64(math.MaxUint64), "Running": true, "Recipe": "PX-200",
+	}
+	if len(points[1].Fields) != len(expected) {
+		t.Fatalf("expected fields %v, got %v", expected, points[1].Fields)
+	}
+	for key, val := range expected {
+		if points[1].Fields[key] != val {
+			t.Errorf("expected %s=%v (%T), got %v (%T)", key, val, val, points[1].Fields[key], points[1].Fields[key])
+		}
+	}
+	if points[1].Tags["group"] != "plant1" || points[1].Tags["edge_node"] != "line3" || points[1].Tags["device"] != "" {
+		t.Errorf("unexpected tags: %v", points[1].Tags)
+	}
+}
+
+func TestHandle_SparkplugDeathAtReceiveTime(t *testing.T) {
+	h, writes := newRecordingHandler(t)
+	defer h.Close()
+	s := defaultSettings(config{topic: "#"})
+	s.Precision.Default = "ms"
+	h.swapSettings(s)
+
+	// The will message carries the timestamp of the connect, which is also that of the birth
+	h.handle(&paho.Publish{Topic: "spBv1.0/plant1/NBIRTH/line3", Payload: encodeSparkplugPayload(1777636800000,
+		testMetric{name: "bdSeq", datatype: sparkplugInt64, value: int64(4)})})
+	h.handle(&paho.Publish{Topic: "spBv1.0/plant1/NDEATH/line3", Payload: encodeSparkplugPayload(1777636800000,
+		testMetric{name: "bdSeq", datatype: sparkplugInt64, value: int64(4)})})
+
+	if _, err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	var birth, death string
+	for _, line := range writes()["sparkplug ms"] {
+		switch {
+		case strings.Contains(line, "online=true"):
+			birth = line[strings.LastIndex(line, " ")+1:]
+		case strings.Contains(line, "online=false"):
+			death = line[strings.LastIndex(line, " ")+1:]
+		}
+	}
+	if birth != "1777636800000" || death == "" || death == birth {
+		t.Errorf("expected the death at the receive time, after the birth at 1777636800000; got birth %q and death %q", birth, death)
+	}
+}
+
+func TestHandle_SparkplugLifecycle(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+
+	publish := func(topic string, payload []byte) {
+		h.handle(&paho.Publish{Topic: topic, Payload: payload})
+	}
+	publish("spBv1.0/plant1/NBIRTH/line3", encodeSparkplugPayload(1777636800000,
+		testMetric{name: "bdSeq", datatype: sparkplugInt64, value: int64(4)},
+		testMetric{name: "Uptime", alias: 1, datatype: sparkplugInt64, value: int64(10)},
+	))
+	publish("spBv1.0/plant1/DBIRTH/line3/press7", encodeSparkplugPayload(1777636800100,
+		testMetric{name: "Force", alias: 2, datatype: sparkplugDouble, value: 12.5},
+	))
+	publish("spBv1.0/plant1/DDATA/line3/press7", encodeSparkplugPayload(1777636801000,
+		testMetric{alias: 2, value: 13.75},
+		testMetric{alias: 9, value: 1.0},
+	))
+
+	h.mu.Lock()
+	node := h.sparkplugNodes["plant1/line3"]
+	h.mu.Unlock()
+	if node == nil || node.aliases[2].name != "Force" || node.bdSeq != 4 || !node.devices["press7"] {
+		t.Fatalf("expected births to be learnt, got %+v", node)
+	}
+
+	// A will message from an earlier session must not mark the node offline
+	publish("spBv1.0/plant1/NDEATH/line3", encodeSparkplugPayload(0, testMetric{name: "bdSeq", datatype: sparkplugInt64, value: int64(3)}))
+	if offline := h.sparkplugDeath(sparkplugTopic{group: "plant1", messageType: "NDEATH", edgeNode: "line3"},
+		sparkplugPayload{metrics: []sparkplugMetric{{name: "bdSeq", intValue: 4, hasValue: true}}}); len(offline) != 2 || offline[1] != "press7" {
+		t.Errorf("expected the node and its device to go offline, got %v", offline)
+	}
+
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	// Two births (status and metrics each) and the data point with the known alias
+	if report.flushed != 5 {
+		t.Errorf("expected 5 points, got %d", report.flushed)
+	}
+}
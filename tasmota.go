@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// tasmotaTimeLayout is the layout of the Time member of Tasmota telemetry, which is in the device's local time.
+// Tasmota omits the UTC offset unless configured to add it, in which case the timestamp is RFC 3339.
+const tasmotaTimeLayout = "2006-01-02T15:04:05"
+
+// tasmotaDevice returns the device topic of a tele/<device>/SENSOR topic
+func tasmotaDevice(topic string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(topic, "tele/"), "/SENSOR")
+}
+
+// buildTasmotaPoint decodes a Tasmota tele/<device>/SENSOR message. Sensor objects such as ENERGY are flattened
+// into fields named <sensor>/<reading> (e.g. ENERGY/Power); strings are skipped. The Time member is used as the point
+// time if present, otherwise the receive time.
+func buildTasmotaPoint(cfg tasmotaSettings, values valueSettings, topic string, payload []byte, at timestamps) (InfluxMessage, error) {
+	var telemetry map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&telemetry); err != nil {
+		return InfluxMessage{}, err
+	}
+
+	timestamp, err := at.parse(telemetry["Time"], timestampFormat{Layout: tasmotaTimeLayout, location: cfg.location})
+	if err != nil {
+		return InfluxMessage{}, fmt.Errorf("invalid Time: %w", err)
+	}
+
+	tags := map[string]string{"device": tasmotaDevice(topic)}
+	values.Strings = "skip"
+	fields := make(map[string]interface{})
+	for key, val := range telemetry {
+		if key == "Time" {
+			continue
+		}
+		flattenValue(values, key, val, fields, tags)
+	}
+
+	return InfluxMessage{
+		Measurement: cfg.Measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        timestamp,
+	}, nil
+}
+
+// handleTasmotaMessage writes the sensor readings of a Tasmota device
+func (o *handler) handleTasmotaMessage(s *settings, msg *paho.Publish, at timestamps) {
+	point, err := buildTasmotaPoint(s.Tasmota, s.Values, msg.Topic, msg.Payload, at)
+	if err != nil {
+		fmt.Printf("Tasmota message could not be parsed (%s): %s\n", msg.Topic, err)
+		return
+	}
+	if len(point.Fields) == 0 {
+		return
+	}
+	o.emit(s, msg, s.Tasmota.Bucket, point)
+}
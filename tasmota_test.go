@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildTasmotaPoint(t *testing.T) {
+	s := defaultSettings(config{})
+	cfg := s.Tasmota
+	cfg.location = time.FixedZone("CEST", 2*60*60)
+	payload := []byte(`{"Time": "2026-05-01T14:00:00", "ENERGY": {"TotalStartTime": "2024-01-10T18:05:07",
+		"Total": 12.345, "Yesterday": 0.421, "Today": 0.118, "Power": 45, "Voltage": 231, "Current": 0.196},
+		"AM2301": {"Temperature": 21.4, "Humidity": 48.2}, "TempUnit": "C"}`)
+
+	point, err := buildTasmotaPoint(cfg, s.Values, "tele/plug-kitchen/SENSOR", payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildTasmotaPoint returned error: %v", err)
+	}
+	if point.Measurement != "tasmota" || point.Tags["device"] != "plug-kitchen" {
+		t.Errorf("unexpected measurement or tags: %q %v", point.Measurement, point.Tags)
+	}
+	if !point.Time.Equal(time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected device time in the configured zone, got %v", point.Time)
+	}
+	expected := map[string]interface{}{
+		"ENERGY/Total": 12.345, "ENERGY/Yesterday": 0.421, "ENERGY/Today": 0.118, "ENERGY/Power": int64(45),
+		"ENERGY/Voltage": int64(231), "ENERGY/Current": 0.196, "AM2301/Temperature": 21.4, "AM2301/Humidity": 48.2,
+	}
+	if len(point.Fields) != len(expected) {
+		t.Fatalf("expected fields %v, got %v", expected, point.Fields)
+	}
+	for key, val := range expected {
+		if point.Fields[key] != val {
+			t.Errorf("expected %s=%v, got %v", key, val, point.Fields[key])
+		}
+	}
+}
+
+func TestTasmotaTimestamps(t *testing.T) {
+	format := timestampFormat{Layout: tasmotaTimeLayout, location: time.FixedZone("CET", 60*60)}
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2026-01-15T08:30:00", time.Date(2026, 1, 15, 7, 30, 0, 0, time.UTC)},
+		{"2026-01-15T08:30:00+02:00", time.Date(2026, 1, 15, 6, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.value, format)
+		if err != nil {
+			t.Fatalf("parseTimestamp(%q) returned error: %v", tt.value, err)
+		}
+		if !got.Equal(tt.expected) {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", tt.value, got, tt.expected)
+		}
+	}
+	if _, err := parseTimestamp("yesterday", format); err == nil {
+		t.Error("expected error for an invalid time")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp sources a rule can choose
+const (
+	sourcePayload  = "payload"  // use the timestamp in the payload, or the receive time if it has none
+	sourceReceived = "received" // always use the time the message was received
+)
+
+// timestampSources lists the values of timestamp.source
+var timestampSources = []string{sourcePayload, sourceReceived}
+
+// epochUnits maps the units of numeric timestamps to their length
+var epochUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// timestampFormat describes how timestamps are written in payloads. Each decoder has its own; a rule can replace
+// any of its members for the topics it matches.
+type timestampFormat struct {
+	Source   string `json:"source"`    // "payload" (default) or "received"
+	Unit     string `json:"unit"`      // unit of numeric timestamps ("s", "ms", "us" or "ns"); blank detects it from the magnitude
+	Layout   string `json:"layout"`    // Go layout of string timestamps that are not RFC 3339
+	TimeZone string `json:"time_zone"` // IANA time zone of layouts without a UTC offset (default UTC)
+
+	location *time.Location
+}
+
+// validate checks the format of a rule
+func (f *timestampFormat) validate() error {
+	var errs []error
+	if f.Source != "" && !containsString(timestampSources, f.Source) {
+		errs = append(errs, fmt.Errorf("unknown source %q (must be one of %s)", f.Source, strings.Join(timestampSources, ", ")))
+	}
+	if _, ok := epochUnits[f.Unit]; f.Unit != "" && !ok {
+		errs = append(errs, fmt.Errorf("unknown unit %q (must be one of s, ms, us, ns)", f.Unit))
+	}
+	if f.TimeZone != "" {
+		if _, err := time.LoadLocation(f.TimeZone); err != nil {
+			errs = append(errs, fmt.Errorf("time_zone: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compile loads the time zone (which validate has checked)
+func (f *timestampFormat) compile() {
+	f.location = nil
+	if f.TimeZone != "" {
+		f.location, _ = time.LoadLocation(f.TimeZone)
+	}
+}
+
+// timestamps turns the timestamps found in one message into times
+type timestamps struct {
+	received time.Time        // used for messages without a timestamp, or for all of them if the rule says so
+	format   *timestampFormat // set by the rule matching the topic (nil if there is none)
+}
+
+// receivedAt returns the timestamps of a message received at t that no rule applies to
+func receivedAt(t time.Time) timestamps {
+	return timestamps{received: t}
+}
+
+// timestampsFor returns the timestamps of a message on topic received at t
+func (s *settings) timestampsFor(topic string, t time.Time) timestamps {
+	at := receivedAt(t)
+	if r := s.ruleFor(topic); r != nil {
+		at.format = r.Timestamp
+	}
+	return at
+}
+
+// fromPayload reports whether timestamps in the payload are used
+func (at timestamps) fromPayload() bool {
+	return at.format == nil || at.format.Source != sourceReceived
+}
+
+// parse returns the time of a timestamp written in the decoder's format (as overridden by the rule). Missing
+// timestamps (nil, empty or zero) and all timestamps of rules using the receive time return the receive time.
+func (at timestamps) parse(value interface{}, format timestampFormat) (time.Time, error) {
+	if !at.fromPayload() || missingTimestamp(value) {
+		return at.received, nil
+	}
+	if at.format != nil {
+		if at.format.Unit != "" {
+			format.Unit = at.format.Unit
+		}
+		if at.format.Layout != "" {
+			format.Layout = at.format.Layout
+		}
+		if at.format.location != nil {
+			format.location = at.format.location
+		}
+	}
+	return parseTimestamp(value, format)
+}
+
+// missingTimestamp reports whether value does not hold a timestamp
+func missingTimestamp(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case json.RawMessage:
+		raw := string(bytes.TrimSpace(v))
+		return raw == "" || raw == "null" || raw == `""` || raw == "0"
+	case json.Number:
+		return v == "" || v == "0"
+	case string:
+		return v == ""
+	case time.Time:
+		return v.IsZero()
+	case float64:
+		return v == 0
+	case int64:
+		return v == 0
+	case uint64:
+		return v == 0
+	}
+	return false
+}
+
+// parseTimestamp parses a numeric or string timestamp. Numbers (and numeric strings) are time since the Unix epoch
+// in format.Unit, detected from their magnitude if the unit is blank; fractions are kept to the nanosecond. Strings
+// are RFC 3339, or written in format.Layout in format.location if the layout has no UTC offset.
+func parseTimestamp(value interface{}, format timestampFormat) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case json.RawMessage:
+		var text string
+		if err := json.Unmarshal(v, &text); err == nil {
+			return parseTimestamp(text, format)
+		}
+		return parseEpoch(string(bytes.TrimSpace(v)), format.Unit)
+	case json.Number:
+		return parseEpoch(string(v), format.Unit)
+	case float64:
+		return parseEpoch(strconv.FormatFloat(v, 'f', -1, 64), format.Unit)
+	case int64:
+		return parseEpoch(strconv.FormatInt(v, 10), format.Unit)
+	case uint64:
+		return parseEpoch(strconv.FormatUint(v, 10), format.Unit)
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, nil
+		}
+		if format.Layout != "" {
+			loc := format.location
+			if loc == nil {
+				loc = time.UTC
+			}
+			if t, err := time.ParseInLocation(format.Layout, v, loc); err == nil {
+				return t, nil
+			}
+		}
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return parseEpoch(v, format.Unit)
+		}
+		if format.Layout != "" {
+			return time.Time{}, fmt.Errorf("timestamp %q is neither RFC 3339 nor in layout %q", v, format.Layout)
+		}
+		return time.Time{}, fmt.Errorf("timestamp %q is not RFC 3339", v)
+	}
+	return time.Time{}, fmt.Errorf("unsupported timestamp %v (%T)", value, value)
+}
+
+// Magnitudes above which epoch timestamps without a unit are taken to be in ms, µs and ns (1e11 s is in the year
+// 5138, 1e11 ms in 1973)
+var (
+	epochMillis = big.NewRat(1e11, 1)
+	epochMicros = big.NewRat(1e14, 1)
+	epochNanos  = big.NewRat(1e17, 1)
+)
+
+// parseEpoch parses a decimal number of units since the Unix epoch without going through a float, so that no
+// precision is lost
+func parseEpoch(text string, unit string) (time.Time, error) {
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", text)
+	}
+	if unit == "" {
+		magnitude := new(big.Rat).Abs(r)
+		switch {
+		case magnitude.Cmp(epochMillis) < 0:
+			unit = "s"
+		case magnitude.Cmp(epochMicros) < 0:
+			unit = "ms"
+		case magnitude.Cmp(epochNanos) < 0:
+			unit = "us"
+		default:
+			unit = "ns"
+		}
+	}
+	length, ok := epochUnits[unit]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown timestamp unit %q", unit)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(int64(length)))
+	nanos := new(big.Int).Quo(r.Num(), r.Denom())
+	sec, nsec := new(big.Int).QuoRem(nanos, big.NewInt(int64(time.Second)), new(big.Int))
+	if !sec.IsInt64() {
+		return time.Time{}, fmt.Errorf("timestamp %s %s is out of range", text, unit)
+	}
+	return time.Unix(sec.Int64(), nsec.Int64()), nil
+}
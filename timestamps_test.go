@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2026, 6, 28, 9, 5, 40, 0, time.UTC)
+	tests := []struct {
+		name     string
+		value    interface{}
+		format   timestampFormat
+		expected time.Time
+	}{
+		{"seconds", json.Number("1782637540"), timestampFormat{}, want},
+		{"milliseconds", json.Number("1782637540236"), timestampFormat{}, want.Add(236 * time.Millisecond)},
+		{"microseconds", json.Number("1782637540236512"), timestampFormat{}, want.Add(236512 * time.Microsecond)},
+		{"nanoseconds", json.Number("1782637540236512789"), timestampFormat{}, want.Add(236512789)},
+		{"float seconds", json.Number("1782637540.236512789"), timestampFormat{}, want.Add(236512789)},
+		{"exponent", json.Number("1.782637540236e12"), timestampFormat{}, want.Add(236 * time.Millisecond)},
+		{"configured unit", json.Number("1782637540"), timestampFormat{Unit: "ms"}, time.UnixMilli(1782637540)},
+		{"fractional milliseconds", json.Number("1782637540236.5"), timestampFormat{Unit: "ms"}, want.Add(236500 * time.Microsecond)},
+		{"numeric string", "1782637540", timestampFormat{}, want},
+		{"raw number", json.RawMessage(`1782637540236`), timestampFormat{}, want.Add(236 * time.Millisecond)},
+		{"raw string", json.RawMessage(`"2026-06-28T09:05:40Z"`), timestampFormat{}, want},
+		{"float64", 1782637540.5, timestampFormat{}, want.Add(500 * time.Millisecond)},
+		{"uint64", uint64(1782637540236), timestampFormat{Unit: "ms"}, want.Add(236 * time.Millisecond)},
+		{"RFC 3339", "2026-06-28T11:05:40.123456789+02:00", timestampFormat{}, want.Add(123456789)},
+		{"layout in UTC", "28/06/2026 09:05:40", timestampFormat{Layout: "02/01/2006 15:04:05"}, want},
+		{"layout in zone", "28/06/2026 11:05:40", timestampFormat{Layout: "02/01/2006 15:04:05", location: berlin}, want},
+		{"RFC 3339 with layout", "2026-06-28T09:05:40Z", timestampFormat{Layout: "02/01/2006 15:04:05", location: berlin}, want},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimestamp(tt.value, tt.format)
+			if err != nil {
+				t.Fatalf("parseTimestamp(%v) returned error: %v", tt.value, err)
+			}
+			if !got.Equal(tt.expected) {
+				t.Errorf("parseTimestamp(%v) = %v, want %v", tt.value, got.UTC(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		format timestampFormat
+	}{
+		{"text", "yesterday", timestampFormat{}},
+		{"not in layout", "2026/06/28", timestampFormat{Layout: "02/01/2006"}},
+		{"object", json.RawMessage(`{"at": 1}`), timestampFormat{}},
+		{"out of range", json.Number("1e30"), timestampFormat{Unit: "s"}},
+		{"boolean", true, timestampFormat{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := parseTimestamp(tt.value, tt.format); err == nil {
+				t.Errorf("expected error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestTimestamps_Parse(t *testing.T) {
+	received := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	payloadTime := time.UnixMilli(1782637540236)
+
+	tests := []struct {
+		name     string
+		format   *timestampFormat
+		value    interface{}
+		expected time.Time
+	}{
+		{"payload time", nil, json.Number("1782637540236"), payloadTime},
+		{"missing", nil, nil, received},
+		{"empty", nil, json.RawMessage(`""`), received},
+		{"zero", nil, json.Number("0"), received},
+		{"receive time", &timestampFormat{Source: sourceReceived}, json.Number("1782637540236"), received},
+		{"rule unit", &timestampFormat{Unit: "s"}, json.Number("1782637540"), time.Unix(1782637540, 0)},
+		{"rule without unit", &timestampFormat{Source: sourcePayload}, json.Number("1782637540236"), payloadTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := timestamps{received: received, format: tt.format}
+			// The decoder writes milliseconds
+			got, err := at.parse(tt.value, timestampFormat{Unit: "ms"})
+			if err != nil {
+				t.Fatalf("parse returned error: %v", err)
+			}
+			if !got.Equal(tt.expected) {
+				t.Errorf("parse(%v) = %v, want %v", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTimestampsFor(t *testing.T) {
+	s := defaultSettings(config{topic: "#"})
+	s.Rules = []rule{{Topic: "sensors/#", Timestamp: &timestampFormat{Unit: "s", TimeZone: "Europe/Amsterdam"}}}
+	s.compile()
+
+	if at := s.timestampsFor("victron/a/grid/1/Ac", time.Now()); at.format != nil {
+		t.Errorf("expected no format for a topic without a rule, got %+v", at.format)
+	}
+	at := s.timestampsFor("sensors/temperature/livingroom/t1", time.Now())
+	if at.format == nil || at.format.Unit != "s" || at.format.location == nil || at.format.location.String() != "Europe/Amsterdam" {
+		t.Errorf("expected the rule's compiled format, got %+v", at.format)
+	}
+}
+
+func TestBuildSolarPoints_TimestampPrecision(t *testing.T) {
+	payload := []byte(`{"model": "SE2200H/inverter", "source": "SE2200H", "timestamp": 1782637540.123456789, "data": {"ac_power_w": 1200}}`)
+	points, err := buildSolarPoints(defaultSettings(config{}).Solar, payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildSolarPoints failed: %v", err)
+	}
+	if len(points) == 0 {
+		t.Fatal("expected points")
+	}
+	for bucket, point := range points {
+		if !point.Time.Equal(time.Unix(1782637540, 123456789)) {
+			t.Errorf("bucket %s: expected the exact payload timestamp, got %v", bucket, point.Time.UnixNano())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// unit describes how to convert a value in this unit to the base unit of its dimension: base = value*scale + offset
+type unit struct {
+	dimension string
+	scale     float64
+	offset    float64
+}
+
+// units lists the units the conversion engine understands (including common spellings)
+var units = map[string]unit{
+	"W":  {"power", 1, 0},
+	"kW": {"power", 1e3, 0},
+	"MW": {"power", 1e6, 0},
+
+	"Wh":  {"energy", 1, 0},
+	"kWh": {"energy", 1e3, 0},
+	"MWh": {"energy", 1e6, 0},
+	"J":   {"energy", 1.0 / 3600, 0},
+	"kJ":  {"energy", 1e3 / 3600, 0},
+
+	"VA":   {"apparent_power", 1, 0},
+	"kVA":  {"apparent_power", 1e3, 0},
+	"var":  {"reactive_power", 1, 0},
+	"kvar": {"reactive_power", 1e3, 0},
+
+	"V":  {"voltage", 1, 0},
+	"mV": {"voltage", 1e-3, 0},
+	"kV": {"voltage", 1e3, 0},
+
+	"A":  {"current", 1, 0},
+	"mA": {"current", 1e-3, 0},
+
+	"Hz":  {"frequency", 1, 0},
+	"kHz": {"frequency", 1e3, 0},
+
+	"°C":   {"temperature", 1, 0},
+	"C":    {"temperature", 1, 0},
+	"degC": {"temperature", 1, 0},
+	"°F":   {"temperature", 5.0 / 9, -32 * 5.0 / 9},
+	"F":    {"temperature", 5.0 / 9, -32 * 5.0 / 9},
+	"degF": {"temperature", 5.0 / 9, -32 * 5.0 / 9},
+	"K":    {"temperature", 1, -273.15},
+
+	"Pa":   {"pressure", 1, 0},
+	"hPa":  {"pressure", 100, 0},
+	"kPa":  {"pressure", 1e3, 0},
+	"mbar": {"pressure", 100, 0},
+	"bar":  {"pressure", 1e5, 0},
+	"psi":  {"pressure", 6894.757293168, 0},
+
+	"m3": {"volume", 1, 0},
+	"m³": {"volume", 1, 0},
+	"l":  {"volume", 1e-3, 0},
+	"L":  {"volume", 1e-3, 0},
+}
+
+// conversion converts matching numeric fields from one unit to another
+type conversion struct {
+	Suffix  string `json:"suffix"`   // fields whose name ends with this suffix (blank matches every field)
+	From    string `json:"from"`     // unit of the incoming value; if blank the point's unit tag is used
+	To      string `json:"to"`       // unit to convert to
+	Rename  string `json:"rename"`   // if set, replaces Suffix in the field name
+	UnitTag bool   `json:"unit_tag"` // set the point's unit tag to the target unit
+}
+
+// validate checks that the conversion refers to known, compatible units
+func (c conversion) validate() error {
+	to, ok := units[c.To]
+	if !ok {
+		return fmt.Errorf("unknown target unit %q", c.To)
+	}
+	if c.From != "" {
+		from, ok := units[c.From]
+		if !ok {
+			return fmt.Errorf("unknown source unit %q", c.From)
+		}
+		if from.dimension != to.dimension {
+			return fmt.Errorf("cannot convert %s (%s) to %s (%s)", c.From, from.dimension, c.To, to.dimension)
+		}
+	}
+	if c.Rename != "" && c.Suffix == "" {
+		return errors.New("rename requires a suffix")
+	}
+	return nil
+}
+
+// validateConversions validates each conversion, naming it by its position in the list
+func validateConversions(name string, conversions []conversion) []error {
+	var errs []error
+	for i, c := range conversions {
+		if err := c.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %w", name, i, err))
+		}
+	}
+	return errs
+}
+
+// convertValue converts val from one unit to another. ok is false if either unit is unknown, the units measure
+// different things or val is not numeric.
+func convertValue(val interface{}, from, to string) (float64, bool) {
+	num, ok := toFloat(val)
+	if !ok {
+		return 0, false
+	}
+	src, ok := units[from]
+	if !ok {
+		return 0, false
+	}
+	dst, ok := units[to]
+	if !ok || src.dimension != dst.dimension {
+		return 0, false
+	}
+	if from == to {
+		return num, true
+	}
+	return (num*src.scale + src.offset - dst.offset) / dst.scale, true
+}
+
+// convertField applies the first conversion matching key (if any). unit is the unit of the value when the
+// conversion does not name one. It returns the (possibly renamed) key, the converted value and the conversion
+// that was applied (nil if the field was left unchanged).
+func convertField(conversions []conversion, key string, val interface{}, unit string) (string, interface{}, *conversion) {
+	for i := range conversions {
+		c := &conversions[i]
+		if !strings.HasSuffix(key, c.Suffix) {
+			continue
+		}
+		from := c.From
+		if from == "" {
+			from = unit
+		}
+		converted, ok := convertValue(val, from, c.To)
+		if !ok {
+			continue
+		}
+		if c.Rename != "" {
+			key = strings.TrimSuffix(key, c.Suffix) + c.Rename
+		}
+		return key, converted, c
+	}
+	return key, val, nil
+}
+
+// applyConversions converts the fields of point. The point's own unit tag is used as the source unit for
+// conversions that do not name one, and is updated by conversions that request it.
+func applyConversions(conversions []conversion, point InfluxMessage) InfluxMessage {
+	if len(conversions) == 0 || len(point.Fields) == 0 {
+		return point
+	}
+
+	// Iterate in a fixed order so that renamed fields collide deterministically
+	keys := make([]string, 0, len(point.Fields))
+	for key := range point.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make(map[string]interface{}, len(point.Fields))
+	unitTag := ""
+	for _, key := range keys {
+		newKey, val, applied := convertField(conversions, key, point.Fields[key], point.Tags["unit"])
+		fields[newKey] = val
+		if applied != nil && applied.UnitTag {
+			unitTag = applied.To
+		}
+	}
+	point.Fields = fields
+
+	if unitTag != "" {
+		tags := make(map[string]string, len(point.Tags)+1)
+		for k, v := range point.Tags {
+			tags[k] = v
+		}
+		tags["unit"] = unitTag
+		point.Tags = tags
+	}
+	return point
+}
+
+// toFloat returns val as a float64 if it holds a number
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
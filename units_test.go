@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		val      interface{}
+		from, to string
+		expected float64
+		ok       bool
+	}{
+		{"watt-hours to kilowatt-hours", float64(2500), "Wh", "kWh", 2.5, true},
+		{"kilowatts to watts", float64(1.5), "kW", "W", 1500, true},
+		{"fahrenheit to celsius", float64(212), "°F", "°C", 100, true},
+		{"kelvin to celsius", float64(273.15), "K", "°C", 0, true},
+		{"celsius to fahrenheit", float64(20), "°C", "°F", 68, true},
+		{"millibar to hectopascal", float64(1013), "mbar", "hPa", 1013, true},
+		{"integer input", int64(3000), "W", "kW", 3, true},
+		{"same unit", float64(42), "V", "V", 42, true},
+		{"incompatible units", float64(1), "W", "Wh", 0, false},
+		{"unknown unit", float64(1), "furlong", "m", 0, false},
+		{"non-numeric value", "on", "W", "kW", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := convertValue(tt.val, tt.from, tt.to)
+			if ok != tt.ok {
+				t.Fatalf("convertValue(%v, %q, %q) ok = %v, want %v", tt.val, tt.from, tt.to, ok, tt.ok)
+			}
+			if ok && math.Abs(got-tt.expected) > 1e-9 {
+				t.Errorf("convertValue(%v, %q, %q) = %v, want %v", tt.val, tt.from, tt.to, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyConversions_UsesAndUpdatesUnitTag(t *testing.T) {
+	point := toInfluxMessage(defaultSettings(config{}).Values, "temperature", "livingroom", "t1", sensorMessage{Unit: "°F", Value: 68}, time.Now())
+	conversions := []conversion{{To: "°C", UnitTag: true}}
+
+	converted := applyConversions(conversions, point)
+	if got := converted.Fields["t1"].(float64); math.Abs(got-20) > 1e-9 {
+		t.Errorf("expected 20°C, got %v", got)
+	}
+	if converted.Tags["unit"] != "°C" {
+		t.Errorf("expected unit tag °C, got %q", converted.Tags["unit"])
+	}
+	if point.Tags["unit"] != "°F" {
+		t.Error("applyConversions must not modify the original tag map")
+	}
+}
+
+func TestApplyConversions_RenamesBySuffix(t *testing.T) {
+	point := InfluxMessage{
+		Measurement: "system",
+		Tags:        map[string]string{"vrm_portal_id": "abc"},
+		Fields:      map[string]interface{}{"Ac/Consumption/L1/Power": float64(2300), "Dc/Battery/Soc": float64(80)},
+	}
+	conversions := []conversion{{Suffix: "Power", From: "W", To: "kW", Rename: "Power_kW"}}
+
+	converted := applyConversions(conversions, point)
+	if converted.Fields["Ac/Consumption/L1/Power_kW"] != float64(2.3) {
+		t.Errorf("expected renamed field Power_kW=2.3, got %v", converted.Fields)
+	}
+	if converted.Fields["Dc/Battery/Soc"] != float64(80) {
+		t.Errorf("expected unmatched field unchanged, got %v", converted.Fields)
+	}
+	if _, ok := converted.Tags["unit"]; ok {
+		t.Error("expected no unit tag when unit_tag is not requested")
+	}
+}
+
+func TestConversionValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     conversion
+		valid bool
+	}{
+		{"valid", conversion{Suffix: "_w", From: "W", To: "kW", Rename: "_kw"}, true},
+		{"source from unit tag", conversion{To: "°C"}, true},
+		{"unknown target", conversion{From: "W", To: "horsepower"}, false},
+		{"mismatched dimensions", conversion{From: "mbar", To: "°C"}, false},
+		{"rename without suffix", conversion{From: "W", To: "kW", Rename: "_kw"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid=%v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// valueSettings controls how decoders type numbers and store strings
+type valueSettings struct {
+	Integers *bool  `json:"integers"` // write whole JSON numbers (no fraction or exponent) as integers
+	Strings  string `json:"strings"`  // "field", "tag" or "skip": how string values are stored
+}
+
+// stringModes lists the accepted values of valueSettings.Strings
+var stringModes = []string{"field", "tag", "skip"}
+
+// newBool returns a pointer to b (pointers distinguish "not set" from false)
+func newBool(b bool) *bool {
+	return &b
+}
+
+// typedValue converts a value decoded with json.Decoder.UseNumber to the type it is written to InfluxDB as. ok is
+// false for values that cannot be stored (nulls, objects and arrays).
+func typedValue(cfg valueSettings, value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		if cfg.Integers != nil && *cfg.Integers && !strings.ContainsAny(v.String(), ".eE") {
+			if i, err := v.Int64(); err == nil {
+				return i, true
+			}
+		}
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	_, ok := kindOf(value)
+	return value, ok
+}
+
+// flattenValue stores a decoded JSON value under name. Object members and array elements are stored as
+// <name>/<key> and <name>/<index>; strings go to fields or tags (or are skipped) according to cfg; nulls are skipped.
+func flattenValue(cfg valueSettings, name string, value interface{}, fields map[string]interface{}, tags map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, member := range v {
+			flattenValue(cfg, name+"/"+key, member, fields, tags)
+		}
+	case []interface{}:
+		for i, element := range v {
+			flattenValue(cfg, name+"/"+strconv.Itoa(i), element, fields, tags)
+		}
+	case string:
+		switch cfg.Strings {
+		case "field":
+			fields[name] = v
+		case "tag":
+			tags[name] = v
+		}
+	default:
+		if typed, ok := typedValue(cfg, v); ok {
+			fields[name] = typed
+		}
+	}
+}
+
+// fieldKind is the InfluxDB type of a field
+type fieldKind int
+
+const (
+	floatField fieldKind = iota
+	integerField
+	booleanField
+	stringField
+)
+
+func (k fieldKind) String() string {
+	return [...]string{"float", "integer", "boolean", "string"}[k]
+}
+
+// fieldTypes lists the types a rule's types can give a field
+var fieldTypes = []string{floatField.String(), integerField.String()}
+
+// fieldKindNamed returns the fieldKind whose String is name
+func fieldKindNamed(name string) (fieldKind, bool) {
+	for k := floatField; k <= stringField; k++ {
+		if k.String() == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// kindOf returns the InfluxDB type val is written as (ok is false for types the client cannot write)
+func kindOf(val interface{}) (fieldKind, bool) {
+	switch val.(type) {
+	case float64, float32:
+		return floatField, true
+	case int, int64, int32, uint, uint64, uint32:
+		return integerField, true
+	case bool:
+		return booleanField, true
+	case string:
+		return stringField, true
+	}
+	return 0, false
+}
+
+// coerce converts val to kind if that loses nothing: integers to floats, and whole floats to integers
+func coerce(val interface{}, kind fieldKind) (interface{}, bool) {
+	num, ok := toFloat(val)
+	if !ok {
+		return nil, false
+	}
+	switch kind {
+	case floatField:
+		return num, true
+	case integerField:
+		if num == math.Trunc(num) && math.Abs(num) < 1<<63 {
+			return int64(num), true
+		}
+	}
+	return nil, false
+}
+
+// stableFields returns the fields of point converted to the type each field had when it was first written, so that a
+// field that started out as a float is not rejected by InfluxDB when a whole number arrives (and vice versa). Fields
+// that cannot be converted are dropped and logged. Must be called with o.mu held.
+func (o *handler) stableFields(bucket string, point InfluxMessage) map[string]interface{} {
+	if o.fieldKinds == nil {
+		o.fieldKinds = make(map[string]fieldKind)
+	}
+	var fields map[string]interface{}
+	for key, val := range point.Fields {
+		kind, ok := kindOf(val)
+		if !ok {
+			// nil and other values the client skips are passed through unchanged
+			continue
+		}
+		id := bucket + "/" + point.Measurement + "/" + key
+		known, seen := o.fieldKinds[id]
+		if !seen {
+			o.fieldKinds[id] = kind
+			continue
+		}
+		if known == kind {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]interface{}, len(point.Fields))
+			for k, v := range point.Fields {
+				fields[k] = v
+			}
+		}
+		if converted, ok := coerce(val, known); ok {
+			fields[key] = converted
+		} else {
+			fmt.Printf("Dropping %s value %v for field %q in %s/%s, which holds %s values\n",
+				kind, val, key, bucket, point.Measurement, known)
+			delete(fields, key)
+		}
+	}
+	if fields == nil {
+		return point.Fields
+	}
+	return fields
+}
+
+// applyTypes converts the fields of point named in types to the type given for them, before the first value can decide
+// the type of the field. Values that cannot be converted without loss are dropped and logged.
+func applyTypes(types map[string]string, point InfluxMessage) InfluxMessage {
+	if len(types) == 0 || len(point.Fields) == 0 {
+		return point
+	}
+	fields := make(map[string]interface{}, len(point.Fields))
+	for key, val := range point.Fields {
+		fields[key] = val
+		name, typed := types[key]
+		if !typed {
+			continue
+		}
+		kind, _ := fieldKindNamed(name)
+		if known, ok := kindOf(val); ok && known == kind {
+			continue
+		}
+		if converted, ok := coerce(val, kind); ok {
+			fields[key] = converted
+		} else {
+			fmt.Printf("Dropping value %v for field %q of %s, which is typed %s\n", val, key, point.Measurement, kind)
+			delete(fields, key)
+		}
+	}
+	point.Fields = fields
+	return point
+}
+
+// fieldKindsFileName is the file in the session folder the types of the fields written are saved to
+const fieldKindsFileName = "fields.json"
+
+// loadFieldKinds reads the field types saved by saveFieldKinds (if any), so that after a restart values are converted
+// to the types InfluxDB already holds
+func (o *handler) loadFieldKinds() error {
+	if o.fieldKindsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(o.fieldKindsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %w", o.fieldKindsFile, err)
+	}
+	kinds := make(map[string]fieldKind, len(saved))
+	for id, name := range saved {
+		kind, ok := fieldKindNamed(name)
+		if !ok {
+			return fmt.Errorf("%s: field %q: unknown type %q", o.fieldKindsFile, id, name)
+		}
+		kinds[id] = kind
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fieldKinds = kinds
+	return nil
+}
+
+// saveFieldKinds writes the field types to the file (if there is one), replacing it atomically
+func (o *handler) saveFieldKinds() error {
+	o.mu.Lock()
+	if o.fieldKindsFile == "" || o.fieldKinds == nil {
+		o.mu.Unlock()
+		return nil
+	}
+	saved := make(map[string]string, len(o.fieldKinds))
+	for id, kind := range o.fieldKinds {
+		saved[id] = kind.String()
+	}
+	o.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.fieldKindsFile, data)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// victronPortalSeen records a Venus OS portal id seen on an N/ topic so that keepalive requests are sent to it
+func (o *handler) victronPortalSeen(portal string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.victronPortals == nil {
+		o.victronPortals = make(map[string]bool)
+	}
+	o.victronPortals[portal] = true
+}
+
+// keepalivePortals returns the configured portals plus those seen on N/ topics, sorted and without duplicates
+func (o *handler) keepalivePortals(s *settings) []string {
+	o.mu.Lock()
+	portals := make(map[string]bool, len(o.victronPortals)+len(s.Victron.Portals))
+	for portal := range o.victronPortals {
+		portals[portal] = true
+	}
+	o.mu.Unlock()
+
+	for _, portal := range s.Victron.Portals {
+		portals[portal] = true
+	}
+	result := make([]string, 0, len(portals))
+	for portal := range portals {
+		result = append(result, portal)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// victronKeepalivePayload returns the payload of a keepalive request. The first request makes the GX device publish
+// all of its values; later ones ask it not to do so again.
+func victronKeepalivePayload(first bool) []byte {
+	if first {
+		return nil
+	}
+	return []byte(`{"keepalive-options": ["suppress-republish"]}`)
+}
+
+// victronKeepalive periodically publishes R/<portal>/keepalive for every known Venus OS portal until ctx is done.
+// The interval is re-read from the handler's settings so that it follows reloads.
+func victronKeepalive(ctx context.Context, cm *autopaho.ConnectionManager, h *handler) {
+	requested := make(map[string]bool)
+	for {
+		s := h.currentSettings()
+		interval := s.Victron.KeepaliveInterval.value()
+		if interval > 0 {
+			for _, portal := range h.keepalivePortals(s) {
+				_, err := cm.Publish(ctx, &paho.Publish{
+					Topic:   "R/" + portal + "/keepalive",
+					QoS:     0,
+					Payload: victronKeepalivePayload(!requested[portal]),
+				})
+				if err != nil {
+					fmt.Printf("failed to send Victron keepalive to %s: %s\n", portal, err)
+					continue
+				}
+				requested[portal] = true
+			}
+		} else {
+			interval = time.Minute // check again later in case keepalives are enabled by a reload
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// victronBatteryTags lists the members of a Batteries entry that identify the battery and are stored as tags
+var victronBatteryTags = []string{"id", "name", "instance"}
+
+// buildVictronBatteryPoints decodes the Batteries array published by the system service into one point per battery,
+// with the battery's id, name and instance as tags and its other members (soc, voltage, current, power, ...) as fields.
+func buildVictronBatteryPoints(cfg valueSettings, topic string, payload []byte, at timestamps) (string, []InfluxMessage, error) {
+	parsed, victronMessage, err := parseVictronMessage(topic, payload)
+	if err != nil {
+		return "", nil, err
+	}
+	batteries, ok := victronMessage.Value.([]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("topic %q: expected an array of batteries, got %T", topic, victronMessage.Value)
+	}
+
+	timestamp, err := victronMessage.time(at)
+	if err != nil {
+		return "", nil, fmt.Errorf("topic %q: invalid timestamp: %w", topic, err)
+	}
+	points := make([]InfluxMessage, 0, len(batteries))
+	for i, entry := range batteries {
+		battery, ok := entry.(map[string]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("topic %q: battery %d is %T, not an object", topic, i, entry)
+		}
+		tags := map[string]string{
+			"vrm_portal_id":   parsed.portal,
+			"device_instance": parsed.instance,
+		}
+		fields := make(map[string]interface{})
+		for key, val := range battery {
+			if containsString(victronBatteryTags, key) {
+				if val != nil {
+					tags["battery_"+key] = fmt.Sprintf("%v", val)
+				}
+				continue
+			}
+			flattenValue(cfg, key, val, fields, tags)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		points = append(points, InfluxMessage{
+			Measurement: "battery",
+			Tags:        tags,
+			Fields:      fields,
+			Time:        timestamp,
+		})
+	}
+	return "victron", points, nil
+}
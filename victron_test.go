@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestBuildVictronPoint_VenusOSTopic(t *testing.T) {
+	received := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	bucket, point, err := buildVictronPoint(defaultSettings(config{}).Values, "N/c0619ab1f2e3/system/0/Ac/Grid/L1/Power", []byte(`{"value": 812.5}`), receivedAt(received))
+	if err != nil {
+		t.Fatalf("buildVictronPoint returned error: %v", err)
+	}
+	if bucket != "victron" {
+		t.Errorf("expected bucket victron, got %q", bucket)
+	}
+	if point.Measurement != "system" || point.Tags["vrm_portal_id"] != "c0619ab1f2e3" || point.Tags["device_instance"] != "0" {
+		t.Errorf("unexpected measurement or tags: %q %v", point.Measurement, point.Tags)
+	}
+	if point.Fields["Ac/Grid/L1/Power"] != 812.5 {
+		t.Errorf("expected Ac/Grid/L1/Power=812.5, got %v", point.Fields)
+	}
+	if !point.Time.Equal(received) {
+		t.Errorf("expected receive time %v for payload without timestamp, got %v", received, point.Time)
+	}
+}
+
+func TestBuildVictronPoint_NoValue(t *testing.T) {
+	for name, payload := range map[string]string{
+		"empty payload":   "",
+		"null value":      `{"value": null}`,
+		"no value member": `{"full-publish-completed-echo": "abc"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := buildVictronPoint(defaultSettings(config{}).Values, "N/c0619ab1f2e3/system/0/Serial", []byte(payload), receivedAt(time.Now()))
+			if !errors.Is(err, errNoVictronValue) {
+				t.Errorf("expected errNoVictronValue, got %v", err)
+			}
+		})
+	}
+}
+
+func TestKeepalivePortals(t *testing.T) {
+	h := &handler{}
+	h.handle(&paho.Publish{Topic: "N/c0619ab1f2e3/system/0/Serial", Payload: []byte(`{"value": null}`)})
+
+	s := defaultSettings(config{})
+	s.Victron.Portals = []string{"a7f3c19de82b", "c0619ab1f2e3"}
+	portals := h.keepalivePortals(s)
+	if len(portals) != 2 || portals[0] != "a7f3c19de82b" || portals[1] != "c0619ab1f2e3" {
+		t.Errorf("expected configured and seen portals without duplicates, got %v", portals)
+	}
+}
+
+func TestVictronKeepalivePayload(t *testing.T) {
+	if payload := victronKeepalivePayload(true); len(payload) != 0 {
+		t.Errorf("expected empty payload for the first keepalive, got %s", payload)
+	}
+	if payload := string(victronKeepalivePayload(false)); payload != `{"keepalive-options": ["suppress-republish"]}` {
+		t.Errorf("expected suppress-republish option for later keepalives, got %s", payload)
+	}
+}
+
+func TestBuildVictronPoint_FlattensStructuredValues(t *testing.T) {
+	payload := []byte(`{"value": {"L1": {"Power": 230.5, "Relay": true, "Name": "grid"}, "Phases": [1, 2]}, "timestamp": 1782637540236}`)
+	_, point, err := buildVictronPoint(defaultSettings(config{}).Values, "victron/a7f3c19de82b/grid/40/Ac", payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildVictronPoint returned error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"Ac/L1/Power": 230.5, "Ac/L1/Relay": true, "Ac/L1/Name": "grid", "Ac/Phases/0": int64(1), "Ac/Phases/1": int64(2),
+	}
+	if len(point.Fields) != len(expected) {
+		t.Fatalf("expected fields %v, got %v", expected, point.Fields)
+	}
+	for key, val := range expected {
+		if point.Fields[key] != val {
+			t.Errorf("expected %s=%v, got %v", key, val, point.Fields[key])
+		}
+	}
+
+	skipStrings := valueSettings{Integers: newBool(true), Strings: "skip"}
+	if _, _, err := buildVictronPoint(skipStrings, "victron/a7f3c19de82b/system/0/Serial", []byte(`{"value": "HQ2207ABCDE"}`), receivedAt(time.Now())); err == nil {
+		t.Error("expected error for a value without data to store as a field")
+	}
+}
+
+func TestBuildVictronBatteryPoints(t *testing.T) {
+	payload := []byte(`{"value": [
+		{"id": "com.victronenergy.battery.socketcan_vecan1", "name": "Pylontech battery", "instance": 512,
+		 "soc": 53, "voltage": 50.09, "current": 12.3, "power": 616, "active_battery_service": true},
+		{"id": "com.victronenergy.battery.ttyUSB0", "name": "Lynx BMS", "instance": 279, "soc": 88, "power": null}
+	], "timestamp": 1782637542140}`)
+
+	bucket, points, err := buildVictronBatteryPoints(defaultSettings(config{}).Values, "victron/f29b4d80a6ce/system/0/Batteries", payload, receivedAt(time.Now()))
+	if err != nil {
+		t.Fatalf("buildVictronBatteryPoints returned error: %v", err)
+	}
+	if bucket != "victron" || len(points) != 2 {
+		t.Fatalf("expected 2 points in the victron bucket, got %d in %q", len(points), bucket)
+	}
+
+	first := points[0]
+	if first.Measurement != "battery" || first.Tags["battery_id"] != "com.victronenergy.battery.socketcan_vecan1" ||
+		first.Tags["battery_name"] != "Pylontech battery" || first.Tags["battery_instance"] != "512" {
+		t.Errorf("unexpected measurement or tags: %q %v", first.Measurement, first.Tags)
+	}
+	if first.Fields["soc"] != int64(53) || first.Fields["power"] != int64(616) || first.Fields["active_battery_service"] != true {
+		t.Errorf("unexpected fields: %v", first.Fields)
+	}
+	if _, ok := first.Fields["id"]; ok {
+		t.Error("expected id to be stored as a tag, not a field")
+	}
+	if _, ok := points[1].Fields["power"]; ok {
+		t.Error("expected null members to be skipped")
+	}
+	if !first.Time.Equal(time.UnixMilli(1782637542140)) {
+		t.Errorf("expected payload timestamp, got %v", first.Time)
+	}
+
+	if _, _, err := buildVictronBatteryPoints(defaultSettings(config{}).Values, "victron/f29b4d80a6ce/system/0/Batteries", []byte(`{"value": 3}`), receivedAt(time.Now())); err == nil {
+		t.Error("expected error for a Batteries value that is not an array")
+	}
+}
+
+func TestBuildVictronPoint_TypedValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      valueSettings
+		payload  string
+		field    interface{} // expected value of the "ProductName" field (nil if it must not exist)
+		tag      string      // expected value of the "ProductName" tag
+		hasError bool
+	}{
+		{"integer", valueSettings{Integers: newBool(true), Strings: "field"}, `{"value": 41}`, int64(41), "", false},
+		{"integers disabled", valueSettings{Integers: newBool(false), Strings: "field"}, `{"value": 41}`, 41.0, "", false},
+		{"exponent is a float", valueSettings{Integers: newBool(true), Strings: "field"}, `{"value": 4e1}`, 40.0, "", false},
+		{"boolean", valueSettings{Integers: newBool(true), Strings: "field"}, `{"value": false}`, false, "", false},
+		{"string field", valueSettings{Integers: newBool(true), Strings: "field"}, `{"value": "MultiPlus-II"}`, "MultiPlus-II", "", false},
+		{"string tag", valueSettings{Integers: newBool(true), Strings: "tag"}, `{"value": {"ProductName": "MultiPlus-II", "ProductId": 9763}}`, nil, "MultiPlus-II", false},
+		{"skipped string", valueSettings{Integers: newBool(true), Strings: "skip"}, `{"value": "MultiPlus-II"}`, nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := "N/c0619ab1f2e3/vebus/276/ProductName"
+			field, tag := "ProductName", "ProductName"
+			if tt.tag != "" {
+				topic = "N/c0619ab1f2e3/vebus/276"
+				field, tag = "value/ProductName", "value/ProductName"
+			}
+			_, point, err := buildVictronPoint(tt.cfg, topic, []byte(tt.payload), receivedAt(time.Now()))
+			if tt.hasError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildVictronPoint returned error: %v", err)
+			}
+			if got, ok := point.Fields[field]; tt.field != nil && got != tt.field {
+				t.Errorf("expected %s=%v (%T), got %v (%T)", field, tt.field, tt.field, got, got)
+			} else if tt.field == nil && ok {
+				t.Errorf("expected no %s field, got %v", field, got)
+			}
+			if point.Tags[tag] != tt.tag {
+				t.Errorf("expected tag %s=%q, got %q", tag, tt.tag, point.Tags[tag])
+			}
+		})
+	}
+}
+
+func TestStableFields_KeepsFirstType(t *testing.T) {
+	h := &handler{}
+	write := func(val interface{}) map[string]interface{} {
+		return h.stableFields("victron", InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"Soc": val}})
+	}
+
+	if fields := write(52.5); fields["Soc"] != 52.5 {
+		t.Errorf("expected first value to be written unchanged, got %v", fields)
+	}
+	if fields := write(int64(53)); fields["Soc"] != 53.0 {
+		t.Errorf("expected integer to be written as float, got %v (%T)", fields["Soc"], fields["Soc"])
+	}
+	if fields := write("full"); len(fields) != 0 {
+		t.Errorf("expected string to be dropped from a float field, got %v", fields)
+	}
+
+	other := h.stableFields("victron", InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"State": int64(3)}})
+	if other["State"] != int64(3) {
+		t.Errorf("expected fields to be tracked separately, got %v", other)
+	}
+	if fields := h.stableFields("victron", InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"State": 4.0}}); fields["State"] != int64(4) {
+		t.Errorf("expected whole float to be written as integer, got %v (%T)", fields["State"], fields["State"])
+	}
+	if fields := h.stableFields("victron", InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"State": 4.5}}); len(fields) != 0 {
+		t.Errorf("expected fractional value to be dropped from an integer field, got %v", fields)
+	}
+}
+
+func TestStableFields_SavedAndLoaded(t *testing.T) {
+	file := filepath.Join(t.TempDir(), fieldKindsFileName)
+	saved := &handler{fieldKindsFile: file}
+	saved.stableFields("victron", InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"Soc": int64(52)}})
+	if err := saved.saveFieldKinds(); err != nil {
+		t.Fatalf("saveFieldKinds returned error: %v", err)
+	}
+
+	loaded := &handler{fieldKindsFile: file}
+	if err := loaded.loadFieldKinds(); err != nil {
+		t.Fatalf("loadFieldKinds returned error: %v", err)
+	}
+	if fields := loaded.stableFields("victron", InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"Soc": 52.5}}); len(fields) != 0 {
+		t.Errorf("expected the saved integer type to apply after a restart, got %v", fields)
+	}
+
+	missing := &handler{fieldKindsFile: filepath.Join(t.TempDir(), fieldKindsFileName)}
+	if err := missing.loadFieldKinds(); err != nil {
+		t.Errorf("expected no error without saved field types, got %v", err)
+	}
+}
+
+func TestApplyTypes(t *testing.T) {
+	types := map[string]string{"Soc": "float", "State": "integer"}
+	point := InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"Soc": int64(52), "State": 3.0, "Other": int64(1)}}
+	expected := map[string]interface{}{"Soc": 52.0, "State": int64(3), "Other": int64(1)}
+	if got := applyTypes(types, point).Fields; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	point = InfluxMessage{Measurement: "system", Fields: map[string]interface{}{"State": 3.5}}
+	if got := applyTypes(types, point).Fields; len(got) != 0 {
+		t.Errorf("expected a fraction to be dropped from an integer field, got %v", got)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// zigbeeDevice holds what the Zigbee2MQTT bridge reports about a device
+type zigbeeDevice struct {
+	model  string
+	vendor string
+}
+
+// zigbeeBridgeDevice is an entry of the device list published (retained) on <base topic>/bridge/devices
+type zigbeeBridgeDevice struct {
+	FriendlyName string `json:"friendly_name"`
+	Definition   *struct {
+		Model  string `json:"model"`
+		Vendor string `json:"vendor"`
+	} `json:"definition"` // null for the coordinator and unsupported devices
+}
+
+// zigbeeIgnoredLevels lists the last topic levels Zigbee2MQTT uses for requests and availability rather than state
+var zigbeeIgnoredLevels = []string{"set", "get", "availability"}
+
+// parseZigbeeDevices decodes the bridge's device list into a map of friendly name → device
+func parseZigbeeDevices(payload []byte) (map[string]zigbeeDevice, error) {
+	var list []zigbeeBridgeDevice
+	if err := json.Unmarshal(payload, &list); err != nil {
+		return nil, err
+	}
+	devices := make(map[string]zigbeeDevice, len(list))
+	for _, d := range list {
+		if d.FriendlyName == "" || d.Definition == nil {
+			continue
+		}
+		devices[d.FriendlyName] = zigbeeDevice{model: d.Definition.Model, vendor: d.Definition.Vendor}
+	}
+	return devices, nil
+}
+
+// buildZigbeePoint decodes a device state message published on <base topic>/<friendly name>. Numeric and boolean
+// members become fields (nested objects are flattened), the friendly name becomes the device tag and excluded
+// members are skipped. device holds the model and vendor tags, if known.
+func buildZigbeePoint(cfg zigbeeSettings, values valueSettings, friendlyName string, payload []byte, device *zigbeeDevice, at timestamps) (InfluxMessage, error) {
+	var state map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&state); err != nil {
+		return InfluxMessage{}, err
+	}
+
+	tags := map[string]string{"device": friendlyName}
+	if device != nil {
+		if device.model != "" {
+			tags["model"] = device.model
+		}
+		if device.vendor != "" {
+			tags["vendor"] = device.vendor
+		}
+	}
+
+	// Device state strings ("ON", "idle", ...) are not stored
+	values.Strings = "skip"
+	fields := make(map[string]interface{})
+	for key, val := range state {
+		if containsString(cfg.Exclude, key) {
+			continue
+		}
+		flattenValue(values, key, val, fields, tags)
+	}
+
+	return InfluxMessage{
+		Measurement: cfg.Measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        at.received,
+	}, nil
+}
+
+// handleZigbeeMessage writes the state of a Zigbee2MQTT device, or updates the known devices from the bridge's list
+func (o *handler) handleZigbeeMessage(s *settings, msg *paho.Publish, at timestamps) {
+	cfg := s.Zigbee2MQTT
+	friendlyName := strings.TrimPrefix(msg.Topic, cfg.BaseTopic+"/")
+
+	if strings.HasPrefix(friendlyName, "bridge/") {
+		if friendlyName != "bridge/devices" || !*cfg.DeviceTags {
+			return
+		}
+		devices, err := parseZigbeeDevices(msg.Payload)
+		if err != nil {
+			fmt.Printf("Zigbee2MQTT device list could not be parsed: %s\n", err)
+			return
+		}
+		o.mu.Lock()
+		o.zigbeeDevices = devices
+		o.mu.Unlock()
+		return
+	}
+	levels := strings.Split(friendlyName, "/")
+	if containsString(zigbeeIgnoredLevels, levels[len(levels)-1]) || len(msg.Payload) == 0 {
+		return
+	}
+
+	var device *zigbeeDevice
+	if *cfg.DeviceTags {
+		o.mu.Lock()
+		if d, ok := o.zigbeeDevices[friendlyName]; ok {
+			device = &d
+		}
+		o.mu.Unlock()
+	}
+
+	point, err := buildZigbeePoint(cfg, s.Values, friendlyName, msg.Payload, device, at)
+	if err != nil {
+		fmt.Printf("Zigbee2MQTT message could not be parsed (%s): %s\n", msg.Topic, err)
+		return
+	}
+	if len(point.Fields) == 0 {
+		return
+	}
+	o.emit(s, msg, cfg.Bucket, point)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const zigbeeDevicesPayload = `[
+	{"ieee_address": "0x00124b0024c2a1f0", "type": "Coordinator", "friendly_name": "Coordinator", "definition": null},
+	{"ieee_address": "0x00158d0008a3b7c1", "type": "EndDevice", "friendly_name": "living/climate",
+	 "definition": {"model": "WSDCGQ11LM", "vendor": "Aqara", "description": "Temperature, humidity and pressure sensor"}}
+]`
+
+func TestBuildZigbeePoint(t *testing.T) {
+	cfg := defaultSettings(config{})
+	received := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	payload := []byte(`{"temperature": 21.3, "humidity": 48, "battery": 90, "linkquality": 120, "occupancy": true,
+		"state": "ON", "last_seen": "2026-05-01T12:00:00Z", "update": {"state": "idle", "installed_version": 1}}`)
+
+	point, err := buildZigbeePoint(cfg.Zigbee2MQTT, cfg.Values, "living/climate", payload, &zigbeeDevice{model: "WSDCGQ11LM", vendor: "Aqara"}, receivedAt(received))
+	if err != nil {
+		t.Fatalf("buildZigbeePoint returned error: %v", err)
+	}
+	if point.Measurement != "zigbee2mqtt" || !point.Time.Equal(received) {
+		t.Errorf("unexpected measurement or time: %q %v", point.Measurement, point.Time)
+	}
+	if point.Tags["device"] != "living/climate" || point.Tags["model"] != "WSDCGQ11LM" || point.Tags["vendor"] != "Aqara" {
+		t.Errorf("unexpected tags: %v", point.Tags)
+	}
+	expected := map[string]interface{}{
+		"temperature": 21.3, "humidity": int64(48), "battery": int64(90), "linkquality": int64(120), "occupancy": true,
+	}
+	if len(point.Fields) != len(expected) {
+		t.Fatalf("expected fields %v, got %v", expected, point.Fields)
+	}
+	for key, val := range expected {
+		if point.Fields[key] != val {
+			t.Errorf("expected %s=%v, got %v", key, val, point.Fields[key])
+		}
+	}
+
+	if _, err := buildZigbeePoint(cfg.Zigbee2MQTT, cfg.Values, "plug", []byte(`online`), nil, receivedAt(received)); err == nil {
+		t.Error("expected error for a payload that is not a JSON object")
+	}
+}
+
+func TestParseZigbeeDevices(t *testing.T) {
+	devices, err := parseZigbeeDevices([]byte(zigbeeDevicesPayload))
+	if err != nil {
+		t.Fatalf("parseZigbeeDevices returned error: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("expected only the device with a definition, got %v", devices)
+	}
+	if d := devices["living/climate"]; d.model != "WSDCGQ11LM" || d.vendor != "Aqara" {
+		t.Errorf("unexpected device: %+v", d)
+	}
+}
+
+func TestHandle_Zigbee2MQTT(t *testing.T) {
+	h := newTestInfluxHandler(t, 0)
+	defer h.Close()
+
+	h.handle(&paho.Publish{Topic: "zigbee2mqtt/bridge/devices", Payload: []byte(zigbeeDevicesPayload)})
+	h.handle(&paho.Publish{Topic: "zigbee2mqtt/bridge/state", Payload: []byte(`{"state": "online"}`)})
+	h.handle(&paho.Publish{Topic: "zigbee2mqtt/living/climate/availability", Payload: []byte(`{"state": "online"}`)})
+	h.handle(&paho.Publish{Topic: "zigbee2mqtt/living/climate", Payload: []byte(`{"temperature": 21.3, "humidity": 48}`)})
+
+	if d := h.zigbeeDevices["living/climate"]; d.model != "WSDCGQ11LM" {
+		t.Errorf("expected device list to be stored, got %v", h.zigbeeDevices)
+	}
+	report, err := h.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	if report.flushed != 1 {
+		t.Errorf("expected only the device state to be written, got %d points", report.flushed)
+	}
+	if _, ok := h.writeAPIs["zigbee2mqtt"]; !ok {
+		t.Errorf("expected point in the zigbee2mqtt bucket, got buckets %v", h.writeAPIs)
+	}
+}